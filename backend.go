@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Label keys of backend metrics. backend and server are always set, the others
+// only with -backend.labels.
+var (
+	backendLabelKeys         = []string{"backend", "server"}
+	backendOptionalLabelKeys = []string{"director", "host", "port"}
+)
+
+// Built-in rules for VBE identifiers, tried in order after the -backend.name-rules.
+// The named groups are the label values, backend and director are cleaned of
+// the VCL name. Identifiers no rule matches get the identifier as backend and
+// server "unknown".
+var builtinBackendNameRules = []string{
+	// (prefix:)<uuid>.<name> as by varnish_reload_vcl in 4.1
+	`(?P<server>[0-9A-Za-z]{8}-[0-9A-Za-z]{4}-[0-9A-Za-z]{4}-[89ABab][0-9A-Za-z]{3}-[0-9A-Za-z]{12})(?P<backend>.*)`,
+	// vmod_goto dns backends <vcl>.goto.<id>.(<ip>).(<url>).(ttl:<ttl>)
+	`^(?:[^.]+\.)?(?P<backend>(?P<director>goto))\.[0-9a-f]+\.\((?P<server>[^()]*)\)\.\([a-z]+://(?P<host>[^():/]*)(?::(?P<port>[0-9]+))?[^()]*\)\.\(ttl:[^()]*\)$`,
+	// Director VMODs naming backends by socket address, vmod_goto and vmod_udo
+	// <vcl>.<vmod>.<director>.(sa4:<ip>:<port>)
+	`^(?:[^.]+\.)?[^.()]+\.(?P<backend>(?P<director>[^.()]+))\.\(sa[46]:(?P<server>(?P<host>[^()]*):(?P<port>[0-9]+))\)$`,
+	// <name>(<ip>,<ipv6>,<port>) in 4.0
+	`^(?P<backend>[^()]*)\((?P<server>(?P<host>[^,()]*),[^,()]*,(?P<port>[0-9]+))\)$`,
+	// vmod_dynamic backends <vcl>.<director>(<address>:<port>)
+	`^(?P<backend>(?P<director>[^()]*))\((?P<server>(?P<host>[^()]*?)(?::(?P<port>[0-9]+))?)\)$`,
+	// <name>(<anything>)
+	`(?P<backend>.*)\((?P<server>.*)\)`,
+}
+
+var BackendNames = mustBackendNameParser(nil, nil)
+
+// backendNameParser parses the backend labels from VBE identifiers with rules,
+// regular expressions with named groups. The first matching rule wins.
+type backendNameParser struct {
+	rules     []*regexp.Regexp
+	labelKeys []string
+}
+
+// Returns a parser with the rules tried before the built-in rules, setting the
+// optional labels in addition to backend and server.
+func newBackendNameParser(rules []string, labels []string) (*backendNameParser, error) {
+	p := &backendNameParser{labelKeys: append([]string{}, backendLabelKeys...)}
+	for _, key := range backendOptionalLabelKeys {
+		for _, label := range labels {
+			if label == key {
+				p.labelKeys = append(p.labelKeys, key)
+				break
+			}
+		}
+	}
+	for _, label := range labels {
+		if indexOf(p.labelKeys, label) == -1 {
+			return nil, fmt.Errorf("unknown backend label %q, available labels are %s", label, strings.Join(backendOptionalLabelKeys, ", "))
+		}
+	}
+
+	for _, rule := range append(append([]string{}, rules...), builtinBackendNameRules...) {
+		regex, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backend name rule %q: %s", rule, err)
+		}
+		if regex.SubexpIndex("backend") == -1 {
+			return nil, fmt.Errorf("backend name rule %q has no backend group", rule)
+		}
+		for _, name := range regex.SubexpNames() {
+			if name != "" && indexOf(backendLabelKeys, name) == -1 && indexOf(backendOptionalLabelKeys, name) == -1 {
+				return nil, fmt.Errorf("backend name rule %q has unknown group %q, available groups are %s", rule, name,
+					strings.Join(append(append([]string{}, backendLabelKeys...), backendOptionalLabelKeys...), ", "))
+			}
+		}
+		p.rules = append(p.rules, regex)
+	}
+	return p, nil
+}
+
+func mustBackendNameParser(rules []string, labels []string) *backendNameParser {
+	p, err := newBackendNameParser(rules, labels)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+// Returns the label values of the VBE identifier, in the order of labelKeys.
+func (p *backendNameParser) parse(ident string) []string {
+	values := make([]string, len(p.labelKeys))
+	for _, rule := range p.rules {
+		match := rule.FindStringSubmatch(ident)
+		if match == nil {
+			continue
+		}
+		for i, key := range p.labelKeys {
+			if group := rule.SubexpIndex(key); group != -1 {
+				values[i] = match[group]
+			}
+		}
+		break
+	}
+
+	for i, key := range p.labelKeys {
+		switch key {
+		case "backend":
+			if values[i] == "" {
+				values[i] = ident
+			}
+			values[i] = cleanBackendName(values[i])
+		case "director":
+			values[i] = cleanBackendName(values[i])
+		case "server":
+			if values[i] == "" {
+				values[i] = "unknown"
+			}
+			values[i] = strings.Replace(values[i], ",,", ":", 1)
+		}
+	}
+	return values
+}
+
+// Reads backend name rules from path, one regular expression per line.
+// Empty lines and lines starting with # are skipped.
+func readBackendNameRules(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	return rules, scanner.Err()
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_BackendNameRules(t *testing.T) {
+	parser, err := newBackendNameParser(nil, []string{"port", "director", "host"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := []string{"backend", "server", "director", "host", "port"}; !matchStringSlices(parser.labelKeys, keys) {
+		t.Fatalf("expected label keys %v, got %v", keys, parser.labelKeys)
+	}
+	for _, test := range []struct {
+		ident    string
+		expected []string // backend, server, director, host, port
+	}{
+		// static backends
+		{"boot.default", []string{"default", "unknown", "", "", ""}},
+		{"reload_20191016_072034_54500.default", []string{"default", "unknown", "", "", ""}},
+		{"eu1_x.y-z:w(192.52.0.192,,8085)", []string{"eu1_x.y-z:w", "192.52.0.192:8085", "", "192.52.0.192", "8085"}}, // 4.0
+		{"ce19737f-72b5-4f4b-9d39-3d8c2d28240b.default", []string{"default", "ce19737f-72b5-4f4b-9d39-3d8c2d28240b", "", "", ""}},
+		// vmod_dynamic
+		{"boot.dyn(192.0.2.10:80)", []string{"dyn", "192.0.2.10:80", "dyn", "192.0.2.10", "80"}},
+		{"reload_20210114_160902_21476.dyn([2001:db8::1]:8080)", []string{"dyn", "[2001:db8::1]:8080", "dyn", "[2001:db8::1]", "8080"}},
+		{"boot.dyn.backend(1.2.3.4:80)", []string{"dyn.backend", "1.2.3.4:80", "dyn.backend", "1.2.3.4", "80"}},
+		// vmod_goto
+		{"boot.goto.00000000.(1.2.3.4).(http://host:80).(ttl:10.000000)", []string{"goto", "1.2.3.4", "goto", "host", "80"}},
+		{"reload_20210114_160902_21476.goto.1a2b3c4d.(2001:db8::1).(https://api.example.com/).(ttl:3600.000000)", []string{"goto", "2001:db8::1", "goto", "api.example.com", ""}},
+		{"boot.goto.d1.(sa4:1.2.3.4:80)", []string{"d1", "1.2.3.4:80", "d1", "1.2.3.4", "80"}},
+		{"boot.goto.d1.(sa6:[2001:db8::1]:443)", []string{"d1", "[2001:db8::1]:443", "d1", "[2001:db8::1]", "443"}},
+		// vmod_udo
+		{"boot.udo.cluster.(sa4:10.0.0.5:8080)", []string{"cluster", "10.0.0.5:8080", "cluster", "10.0.0.5", "8080"}},
+	} {
+		values := parser.parse(test.ident)
+		t.Logf("%s > %v", test.ident, values)
+		if !matchStringSlices(values, test.expected) {
+			t.Errorf("%s: expected %q, got %q", test.ident, test.expected, values)
+		}
+	}
+
+	// Custom rules are tried first
+	parser, err = newBackendNameParser([]string{`^(?:[^.]+\.)?(?P<director>shard_[a-z]+)_(?P<backend>[a-z0-9]+)$`}, []string{"director"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := parser.parse("boot.shard_eu_web1"); !matchStringSlices(values, []string{"web1", "unknown", "shard_eu"}) {
+		t.Errorf("unexpected custom rule values %q", values)
+	}
+	if values := parser.parse("boot.dyn(192.0.2.10:80)"); !matchStringSlices(values, []string{"dyn", "192.0.2.10:80", "dyn"}) {
+		t.Errorf("unexpected built-in rule values %q", values)
+	}
+
+	for _, invalid := range []struct {
+		rules  []string
+		labels []string
+	}{
+		{[]string{`(?P<server>.*)`}, nil},
+		{[]string{`(?P<backend>.*)(?P<vcl>.*)`}, nil},
+		{[]string{`(?P<backend>.*`}, nil},
+		{nil, []string{"vcl"}},
+	} {
+		if _, err := newBackendNameParser(invalid.rules, invalid.labels); err == nil {
+			t.Errorf("expected error from rules %q labels %q", invalid.rules, invalid.labels)
+		} else {
+			t.Log(err)
+		}
+	}
+}
+
+func Test_ReadBackendNameRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	writeTestFile(t, path, "# shard directors\n\n  ^(?P<backend>shard_[a-z]+)$  \n(?P<backend>.*)\\.\\((?P<server>.*)\\)\n")
+	rules, err := readBackendNameRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{`^(?P<backend>shard_[a-z]+)$`, `(?P<backend>.*)\.\((?P<server>.*)\)`}; !matchStringSlices(rules, expected) {
+		t.Errorf("expected %q, got %q", expected, rules)
+	}
+	if _, err := readBackendNameRules(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("expected error from missing file")
+	}
+}
+
+// All backend metrics have the same labels whichever rule matched
+func Test_BackendLabelsConsistent(t *testing.T) {
+	dir, _ := os.Getwd()
+	stats, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape/synthetic-7.6.1.json"))
+	if err != nil {
+		t.Skipf("Cannot read test file: %s", err)
+	}
+	gotoCounter := `"VBE.reload_20210114_160902_21476.goto.00000000.(192.0.2.20).(http://origin.example.com:80).(ttl:10.000000).happy": {"description": "Happy health probes", "flag": "b", "format": "b", "value": 1},`
+	stats = []byte(strings.Replace(string(stats), `"counters": {`, `"counters": {`+gotoCounter, 1))
+
+	previous := BackendNames
+	defer func() { BackendNames = previous }()
+	BackendNames = mustBackendNameParser(nil, []string{"director", "host", "port"})
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		if _, err := ScrapeVarnishFrom(context.Background(), testTarget, stats, ch, nil); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		if family.GetName() != "varnish_backend_up" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			t.Logf("%v", labels)
+			if len(labels) != 5 {
+				t.Errorf("unexpected labels %v", labels)
+			}
+			if labels["backend"] == "goto" {
+				found = labels["server"] == "192.0.2.20" && labels["host"] == "origin.example.com" && labels["port"] == "80"
+			}
+		}
+	}
+	if !found {
+		t.Error("goto backend not found")
+	}
+}
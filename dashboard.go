@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Grafana dashboard JSON model, see https://grafana.com/docs/grafana/latest/dashboards/build-dashboards/view-dashboard-json-model/
+type grafanaDashboard struct {
+	Inputs        []*grafanaInput `json:"__inputs"`
+	UID           string          `json:"uid"`
+	Title         string          `json:"title"`
+	Tags          []string        `json:"tags"`
+	Editable      bool            `json:"editable"`
+	SchemaVersion int             `json:"schemaVersion"`
+	Refresh       string          `json:"refresh"`
+	Time          grafanaTime     `json:"time"`
+	Templating    struct {
+		List []*grafanaVariable `json:"list"`
+	} `json:"templating"`
+	Panels []*grafanaPanel `json:"panels"`
+}
+
+// Datasource to select when the dashboard is imported
+type grafanaInput struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	PluginID string `json:"pluginId"`
+}
+
+type grafanaTime struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type grafanaDatasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type grafanaVariable struct {
+	Name       string             `json:"name"`
+	Label      string             `json:"label"`
+	Type       string             `json:"type"`
+	Datasource *grafanaDatasource `json:"datasource"`
+	Query      string             `json:"query"`
+	Refresh    int                `json:"refresh"` // 2 on time range change
+	Multi      bool               `json:"multi"`
+	IncludeAll bool               `json:"includeAll"`
+	AllValue   string             `json:"allValue,omitempty"`
+	Sort       int                `json:"sort"`
+}
+
+type grafanaPanel struct {
+	ID          int                 `json:"id"`
+	Type        string              `json:"type"`
+	Title       string              `json:"title"`
+	Description string              `json:"description,omitempty"`
+	Datasource  *grafanaDatasource  `json:"datasource,omitempty"`
+	GridPos     grafanaGridPos      `json:"gridPos"`
+	Collapsed   bool                `json:"collapsed,omitempty"`
+	Panels      []*grafanaPanel     `json:"panels,omitempty"` // of a collapsed row
+	Targets     []*grafanaTarget    `json:"targets,omitempty"`
+	FieldConfig *grafanaFieldConfig `json:"fieldConfig,omitempty"`
+}
+
+type grafanaGridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type grafanaTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+type grafanaFieldConfig struct {
+	Defaults struct {
+		Unit string `json:"unit"`
+	} `json:"defaults"`
+}
+
+var grafanaPrometheus = &grafanaDatasource{Type: "prometheus", UID: "${DS_PROMETHEUS}"}
+
+// Prints a Grafana dashboard of the metrics exported from varnishstat or a varnishstat -j
+// output file. Returns the exit code.
+func dashboardCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("dashboard", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("file", "", "varnishstat -j output file to read instead of running varnishstat.")
+	title := fs.String("title", "Varnish", "Dashboard title.")
+	varnishFlags(fs)
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s dashboard [flags]\n\nPrints a Grafana dashboard with a row of panels for each group of exported metrics.\n\n", ApplicationName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := LogConfig.Initialize(stderr, StartParams.Raw); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := applyVarnishFlags(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	shapes, err := metricShapes(context.Background(), *file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	buf, err := json.MarshalIndent(varnishDashboard(*title, shapes), "", "  ")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if _, err := fmt.Fprintf(stdout, "%s\n", buf); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Returns a dashboard with an overview row and a collapsed row for each metric group.
+func varnishDashboard(title string, shapes []*metricShape) *grafanaDashboard {
+	dashboard := &grafanaDashboard{
+		Inputs:        []*grafanaInput{{Name: "DS_PROMETHEUS", Label: "Prometheus", Type: "datasource", PluginID: "prometheus"}},
+		UID:           "varnish-exporter",
+		Title:         title,
+		Tags:          []string{"varnish", "prometheus"},
+		Editable:      true,
+		SchemaVersion: 39,
+		Refresh:       "1m",
+		Time:          grafanaTime{From: "now-6h", To: "now"},
+	}
+	dashboard.Templating.List = append(dashboard.Templating.List, &grafanaVariable{
+		Name: "instance", Label: "Instance", Type: "query", Datasource: grafanaPrometheus,
+		Query: "label_values(varnish_up, instance)", Refresh: 2, Multi: true, IncludeAll: true, AllValue: ".*", Sort: 1,
+	})
+
+	byName := make(map[string]*metricShape)
+	byGroup := make(map[string][]*metricShape)
+	var backend *metricShape
+	var derived []*metricShape // from several counters, in the overview
+	for _, shape := range shapes {
+		byName[shape.name] = shape
+		if len(shape.counters) == 0 {
+			derived = append(derived, shape)
+			continue
+		}
+		group := prometheusGroup(shape.counters[0])
+		byGroup[group] = append(byGroup[group], shape)
+		if backend == nil && isBackendShape(shape) {
+			backend = shape
+		}
+	}
+	if backend != nil {
+		dashboard.Templating.List = append(dashboard.Templating.List, &grafanaVariable{
+			Name: "backend", Label: "Backend", Type: "query", Datasource: grafanaPrometheus,
+			Query: fmt.Sprintf(`label_values(%s{instance=~"$instance"}, backend)`, backend.name), Refresh: 2, Multi: true, IncludeAll: true, AllValue: ".*", Sort: 1,
+		})
+	}
+
+	id := 0
+	nextID := func() int {
+		id++
+		return id
+	}
+	y := 0
+
+	dashboard.Panels = append(dashboard.Panels, &grafanaPanel{ID: nextID(), Type: "row", Title: "Overview", GridPos: grafanaGridPos{H: 1, W: 24, Y: y}})
+	overview := []*grafanaPanel{
+		grafanaGraph(nextID(), "Up", "Whether the last scrape of varnishstat succeeded", "none", `varnish_up{instance=~"$instance"}`, "{{instance}}"),
+	}
+	if byName["varnish_main_cache_hit"] != nil && byName["varnish_main_cache_miss"] != nil {
+		hit, miss := `rate(varnish_main_cache_hit{instance=~"$instance"}[$__rate_interval])`, `rate(varnish_main_cache_miss{instance=~"$instance"}[$__rate_interval])`
+		overview = append(overview, grafanaGraph(nextID(), "Cache hit ratio", "Cache hits of hits and misses, as calculated by Varnish", "percentunit",
+			fmt.Sprintf("%s / (%s + %s)", hit, hit, miss), "{{instance}}"))
+	}
+	if shape := byName["varnish_main_client_req"]; shape != nil {
+		overview = append(overview, grafanaMetricPanel(nextID(), shape))
+	}
+	if shape := byName["varnish_backend_up"]; shape != nil {
+		overview = append(overview, grafanaMetricPanel(nextID(), shape))
+	}
+	for _, shape := range derived {
+		overview = append(overview, grafanaMetricPanel(nextID(), shape))
+	}
+	y = layoutGrafanaPanels(overview, y+1)
+	dashboard.Panels = append(dashboard.Panels, overview...)
+
+	// Groups in the order of their prefixes, main first
+	order := []string{"main"}
+	for _, group := range groups {
+		if indexOf(order, group.name) == -1 {
+			order = append(order, group.name)
+		}
+	}
+	for _, group := range order {
+		if len(byGroup[group]) == 0 {
+			continue
+		}
+		row := &grafanaPanel{ID: nextID(), Type: "row", Title: exporterNamespace + "_" + group + "_*", Collapsed: true, GridPos: grafanaGridPos{H: 1, W: 24, Y: y}}
+		for _, shape := range byGroup[group] {
+			row.Panels = append(row.Panels, grafanaMetricPanel(nextID(), shape))
+		}
+		y = layoutGrafanaPanels(row.Panels, y+1)
+		dashboard.Panels = append(dashboard.Panels, row)
+	}
+	return dashboard
+}
+
+// Returns a time series panel of the metrics of shape, the rate of counters.
+func grafanaMetricPanel(id int, shape *metricShape) *grafanaPanel {
+	selector := `instance=~"$instance"`
+	if isBackendShape(shape) {
+		selector += `,backend=~"$backend"`
+	}
+	expr := shape.name + "{" + selector + "}"
+	legend := "{{instance}}"
+	for _, label := range shape.labels {
+		legend += " {{" + label + "}}"
+	}
+
+	unit := "short"
+	switch {
+	case strings.HasSuffix(shape.name, "_bytes") && shape.typ == "counter":
+		unit = "Bps"
+	case strings.HasSuffix(shape.name, "_bytes"):
+		unit = "bytes"
+	case strings.HasSuffix(shape.name, "_seconds"):
+		unit = "s"
+	case strings.HasSuffix(shape.name, "_ratio"):
+		unit = "percentunit"
+	case shape.typ == "counter":
+		unit = "ops"
+	}
+	if shape.typ == "counter" {
+		expr = "rate(" + expr + "[$__rate_interval])"
+	}
+	return grafanaGraph(id, strings.TrimPrefix(shape.name, exporterNamespace+"_"), shape.help, unit, expr, legend)
+}
+
+// Whether the metrics of shape are filtered by the backend variable.
+func isBackendShape(shape *metricShape) bool {
+	return strings.HasPrefix(shape.name, exporterNamespace+"_backend_") && indexOf(shape.labels, "backend") != -1
+}
+
+func grafanaGraph(id int, title, description, unit, expr, legend string) *grafanaPanel {
+	panel := &grafanaPanel{
+		ID:          id,
+		Type:        "timeseries",
+		Title:       title,
+		Description: description,
+		Datasource:  grafanaPrometheus,
+		Targets:     []*grafanaTarget{{RefID: "A", Expr: expr, LegendFormat: legend}},
+		FieldConfig: &grafanaFieldConfig{},
+	}
+	panel.FieldConfig.Defaults.Unit = unit
+	return panel
+}
+
+// Lays out panels three per line starting from y, returns the y after them.
+func layoutGrafanaPanels(panels []*grafanaPanel, y int) int {
+	for i, panel := range panels {
+		panel.GridPos = grafanaGridPos{H: 8, W: 8, X: (i % 3) * 8, Y: y + (i/3)*8}
+	}
+	return y + (len(panels)+2)/3*8
+}
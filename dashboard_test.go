@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_Dashboard(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixtures, _ := filepath.Glob(filepath.Join(dir, "test/scrape/*.json"))
+	if len(fixtures) == 0 {
+		t.Skipf("Cannot find test/scrape files from working dir %s", dir)
+	}
+	t.Cleanup(func() {
+		LogConfig.Initialize(os.Stdout, false)
+	})
+
+	for _, fixture := range fixtures {
+		version := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		shapes, err := metricShapes(context.Background(), fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// varnish_up is not from a varnishstat counter
+		exported := map[string]bool{"varnish_up": true}
+		for _, shape := range shapes {
+			exported[shape.name] = true
+		}
+
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		if code := dashboardCommand([]string{"-file", fixture, "-title", "Varnish " + version}, stdout, stderr); code != 0 {
+			t.Fatalf("%s: exit %d: %s", version, code, stderr)
+		}
+		var dashboard struct {
+			Title      string `json:"title"`
+			UID        string `json:"uid"`
+			Templating struct {
+				List []struct {
+					Name  string `json:"name"`
+					Query string `json:"query"`
+				} `json:"list"`
+			} `json:"templating"`
+			Panels []struct {
+				grafanaPanelTest
+				Panels []grafanaPanelTest `json:"panels"`
+			} `json:"panels"`
+		}
+		if err := json.Unmarshal(stdout.Bytes(), &dashboard); err != nil {
+			t.Fatalf("%s: %s", version, err)
+		}
+		if dashboard.Title != "Varnish "+version || dashboard.UID == "" {
+			t.Errorf("%s: unexpected title %q or uid %q", version, dashboard.Title, dashboard.UID)
+		}
+		variables := make(map[string]bool)
+		for _, variable := range dashboard.Templating.List {
+			variables[variable.Name] = true
+		}
+
+		ids := make(map[int]bool)
+		rows := make(map[string]int)
+		panels := 0
+		check := func(panel grafanaPanelTest) {
+			if ids[panel.ID] {
+				t.Errorf("%s: duplicate panel id %d", version, panel.ID)
+			}
+			ids[panel.ID] = true
+			if panel.GridPos.X+panel.GridPos.W > 24 || panel.GridPos.W == 0 || panel.GridPos.H == 0 {
+				t.Errorf("%s: %s: invalid grid position %+v", version, panel.Title, panel.GridPos)
+			}
+			for _, target := range panel.Targets {
+				for _, metric := range regexRuleMetricName.FindAllString(target.Expr, -1) {
+					if !exported[metric] {
+						t.Errorf("%s: %s: %s is not exported", version, panel.Title, metric)
+					}
+				}
+				for _, variable := range []string{"instance", "backend"} {
+					if strings.Contains(target.Expr, "$"+variable) && !variables[variable] {
+						t.Errorf("%s: %s: no %s variable for %s", version, panel.Title, variable, target.Expr)
+					}
+				}
+			}
+		}
+		for _, panel := range dashboard.Panels {
+			check(panel.grafanaPanelTest)
+			if panel.Type == "row" {
+				rows[panel.Title] = len(panel.Panels)
+			}
+			for _, nested := range panel.Panels {
+				check(nested)
+				panels++
+			}
+		}
+		t.Logf("%s: %d rows %v", version, len(rows), rows)
+
+		// A panel for each metric in the row of its group, the derived metrics in the overview
+		grouped, overview := 0, make(map[string]bool)
+		for _, shape := range shapes {
+			if len(shape.counters) > 0 {
+				grouped++
+			}
+		}
+		for _, panel := range dashboard.Panels {
+			overview[panel.Title] = true
+		}
+		if panels != grouped {
+			t.Errorf("%s: expected %d panels in the group rows, got %d", version, grouped, panels)
+		}
+		if !overview["storage_utilization_ratio"] {
+			t.Errorf("%s: expected a storage_utilization_ratio panel in the overview", version)
+		}
+		if !variables["instance"] || variables["backend"] != exported["varnish_backend_up"] {
+			t.Errorf("%s: unexpected variables %v", version, variables)
+		}
+		for row, present := range map[string]bool{
+			"varnish_main_*":    true,
+			"varnish_backend_*": exported["varnish_backend_happy"],
+			"varnish_mse_*":     exported["varnish_mse_c_fail"],
+			"varnish_smf_*":     exported["varnish_smf_c_fail"],
+		} {
+			if (rows[row] > 0) != present {
+				t.Errorf("%s: expected row %s %v, got %v", version, row, present, rows)
+			}
+		}
+	}
+}
+
+type grafanaPanelTest struct {
+	ID      int    `json:"id"`
+	Type    string `json:"type"`
+	Title   string `json:"title"`
+	GridPos struct {
+		H, W, X, Y int
+	} `json:"gridPos"`
+	Targets []struct {
+		Expr string `json:"expr"`
+	} `json:"targets"`
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricShape is the type and label names of the metrics of a name, what the diff
+// subcommand compares.
+type metricShape struct {
+	name     string
+	help     string
+	typ      string
+	labels   []string // sorted
+	series   int
+	counters []string // varnishstat counters exported as the name, sorted
+}
+
+// Compares the metrics exported from two varnishstat -j output files, returns the exit
+// code: 0 without differences, 1 with differences and 2 on errors, as diff(1).
+func diffCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	varnishFlags(fs)
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s diff [flags] <old varnishstat.json> <new varnishstat.json>\n\n", ApplicationName)
+		fmt.Fprintf(stderr, "Lists the metrics added, removed or with changed labels or type between two varnishstat -j outputs.\nExits with 1 if there are differences.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+	if err := LogConfig.Initialize(stderr, StartParams.Raw); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := applyVarnishFlags(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	ctx := context.Background()
+	var shapes [2][]*metricShape
+	for i, file := range fs.Args() {
+		if file == "" {
+			fmt.Fprintln(stderr, "No varnishstat file")
+			return 2
+		}
+		var err error
+		if shapes[i], err = metricShapes(ctx, file); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 2
+		}
+	}
+	diff := diffMetricShapes(shapes[0], shapes[1])
+	for _, line := range diff {
+		fmt.Fprintln(stdout, line)
+	}
+	if len(diff) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Returns the metrics exported from the varnishstat -j output file, or varnishstat if
+// file is empty, sorted by name.
+func metricShapes(ctx context.Context, file string) ([]*metricShape, error) {
+	metrics, err := scrapeGuardedMetrics(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	var shapes []*metricShape
+	byName := make(map[string]*metricShape)
+	for _, m := range metrics {
+		shape := byName[m.name]
+		if shape == nil {
+			// Label names are the same for all metrics of a name once resolved
+			shape = &metricShape{name: m.name, help: m.help, typ: "gauge", labels: sortedCopy(m.labelKeys)}
+			if m.valueType == prometheus.CounterValue {
+				shape.typ = "counter"
+			}
+			byName[m.name] = shape
+			shapes = append(shapes, shape)
+		}
+		shape.series++
+		if m.counter != "" && indexOf(shape.counters, m.counter) == -1 {
+			shape.counters = append(shape.counters, m.counter)
+		}
+	}
+	for _, shape := range shapes {
+		sort.Strings(shape.counters)
+	}
+	return shapes, nil
+}
+
+// Returns the differences from before to after, removed and added metrics first.
+func diffMetricShapes(before, after []*metricShape) []string {
+	beforeByName := make(map[string]*metricShape)
+	for _, shape := range before {
+		beforeByName[shape.name] = shape
+	}
+	afterByName := make(map[string]*metricShape)
+	for _, shape := range after {
+		afterByName[shape.name] = shape
+	}
+
+	var diff []string
+	for _, shape := range before {
+		if afterByName[shape.name] == nil {
+			diff = append(diff, fmt.Sprintf("removed %s%s %s (%d series)", shape.name, formatLabelNames(shape.labels), shape.typ, shape.series))
+		}
+	}
+	for _, shape := range after {
+		if beforeByName[shape.name] == nil {
+			diff = append(diff, fmt.Sprintf("added %s%s %s (%d series)", shape.name, formatLabelNames(shape.labels), shape.typ, shape.series))
+		}
+	}
+	for _, from := range before {
+		to := afterByName[from.name]
+		if to == nil {
+			continue
+		}
+		if from.typ != to.typ {
+			diff = append(diff, fmt.Sprintf("type of %s changed %s -> %s (%s)", from.name, from.typ, to.typ, strings.Join(to.counters, ",")))
+		}
+		if !sameLabelKeys(from.labels, to.labels) {
+			diff = append(diff, fmt.Sprintf("labels of %s changed %s -> %s", from.name, formatLabelNames(from.labels), formatLabelNames(to.labels)))
+		}
+	}
+	return diff
+}
+
+func formatLabelNames(labels []string) string {
+	return "{" + strings.Join(labels, ",") + "}"
+}
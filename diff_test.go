@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_DiffMetricShapes(t *testing.T) {
+	before := []*metricShape{
+		{name: "varnish_backend_happy", typ: "gauge", labels: []string{"backend", "server"}, series: 2},
+		{name: "varnish_main_n_expired", typ: "gauge", series: 1},
+		{name: "varnish_main_removed", typ: "counter", series: 1},
+	}
+	after := []*metricShape{
+		{name: "varnish_backend_happy", typ: "gauge", labels: []string{"backend", "server", "vcl"}, series: 2},
+		{name: "varnish_main_added", typ: "counter", series: 1},
+		{name: "varnish_main_n_expired", typ: "counter", series: 1, counters: []string{"MAIN.n_expired"}},
+	}
+	diff := diffMetricShapes(before, after)
+	t.Logf("\n%s", strings.Join(diff, "\n"))
+	expected := []string{
+		"removed varnish_main_removed{} counter (1 series)",
+		"added varnish_main_added{} counter (1 series)",
+		"labels of varnish_backend_happy changed {backend,server} -> {backend,server,vcl}",
+		"type of varnish_main_n_expired changed gauge -> counter (MAIN.n_expired)",
+	}
+	if !matchStringSlices(diff, expected) {
+		t.Errorf("expected\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(diff, "\n"))
+	}
+	if diff := diffMetricShapes(before, before); len(diff) != 0 {
+		t.Errorf("expected no differences, got %v", diff)
+	}
+}
+
+func Test_DiffCommand(t *testing.T) {
+	dir, _ := os.Getwd()
+	from, to := filepath.Join(dir, "test/scrape/6.0.0.json"), filepath.Join(dir, "test/scrape/6.5.1.json")
+	if !fileExists(from) || !fileExists(to) {
+		t.Skipf("Cannot find test files %s and %s", from, to)
+	}
+	t.Cleanup(func() {
+		LogConfig.Initialize(os.Stdout, false)
+	})
+
+	run := func(args ...string) (int, string, string) {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := diffCommand(args, stdout, stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, errOut := run(from, to)
+	t.Logf("\n%s", out)
+	if code != 1 {
+		t.Fatalf("expected exit 1 on differences, got %d: %s", code, errOut)
+	}
+	for _, line := range []string{
+		"added varnish_backend_busy{backend,server} counter (1 series)",
+		"type of varnish_main_n_expired changed gauge -> counter (MAIN.n_expired)",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("expected %q", line)
+		}
+	}
+
+	if code, out, errOut := run(to, to); code != 0 || out != "" {
+		t.Errorf("expected exit 0 without differences, got %d: %s%s", code, out, errOut)
+	}
+
+	// Counters renamed between the files
+	tmp := t.TempDir()
+	write := func(name, json string) string {
+		path := filepath.Join(tmp, name)
+		if err := ioutil.WriteFile(path, []byte(json), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	a := write("a.json", `{"version": 1, "counters": {"MAIN.uptime": {"flag": "c", "value": 1}, "MAIN.old": {"flag": "g", "value": 1}}}`)
+	b := write("b.json", `{"version": 1, "counters": {"MAIN.uptime": {"flag": "c", "value": 1}, "MAIN.new": {"flag": "g", "value": 1}}}`)
+	code, out, _ = run(a, b)
+	if expected := "removed varnish_main_old{} gauge (1 series)\nadded varnish_main_new{} gauge (1 series)\n"; code != 1 || out != expected {
+		t.Errorf("expected exit 1 with\n%s\ngot %d\n%s", expected, code, out)
+	}
+
+	// Metrics derived from several counters are compared too
+	c := write("c.json", `{"version": 1, "counters": {"MAIN.uptime": {"flag": "c", "value": 1}, "MAIN.old": {"flag": "g", "value": 1}, "SMA.s0.g_bytes": {"flag": "g", "value": 1}, "SMA.s0.g_space": {"flag": "g", "value": 3}}}`)
+	code, out, _ = run(a, c)
+	t.Logf("\n%s", out)
+	if expected := "added varnish_sma_g_bytes{type} gauge (1 series)\nadded varnish_sma_g_space{type} gauge (1 series)\nadded varnish_storage_utilization_ratio{stevedore,storage} gauge (1 series)\n"; code != 1 || out != expected {
+		t.Errorf("expected exit 1 with\n%s\ngot %d\n%s", expected, code, out)
+	}
+
+	if code, _, _ := run(from); code != 2 {
+		t.Errorf("expected exit 2 with one file, got %d", code)
+	}
+	if code, _, errOut := run(from, filepath.Join(tmp, "missing.json")); code != 2 || errOut == "" {
+		t.Errorf("expected exit 2 with error on missing file, got %d %q", code, errOut)
+	}
+	if code, _, errOut := run(from, write("invalid.json", "Could not get hold of varnishd")); code != 2 || errOut == "" {
+		t.Errorf("expected exit 2 with error on invalid file, got %d %q", code, errOut)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const varnishDefaultStateDir = "/var/lib/varnish"
+
+type discoveryParams struct {
+	Enabled   bool
+	Interval  time.Duration
+	StateDirs string
+}
+
+// discoverySource scrapes all varnishd instances running on this host. Instances are
+// found from live VSM segments in the state directories and from the -n argument of
+// varnishd processes in /proc. Discovery is repeated every -discovery.interval,
+// in between the last found instances are scraped.
+type discoverySource struct {
+	sync.Mutex
+
+	stateDirs []string
+	procDir   string
+	interval  time.Duration
+	hostname  string
+	getenv    func(string) string
+
+	discovered time.Time
+	targets    map[string]*scrapeTarget // by working directory
+}
+
+func newDiscoverySource(params *discoveryParams) *discoverySource {
+	s := &discoverySource{
+		procDir:  "/proc",
+		interval: params.Interval,
+		getenv:   os.Getenv,
+		targets:  make(map[string]*scrapeTarget),
+	}
+	for _, dir := range strings.Split(params.StateDirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			s.stateDirs = append(s.stateDirs, filepath.Clean(dir))
+		}
+	}
+	if len(s.stateDirs) == 0 {
+		s.stateDirs = []string{varnishDefaultStateDir}
+	}
+	s.hostname, _ = os.Hostname()
+	return s
+}
+
+func (s *discoverySource) LabelKeys() []string {
+	return []string{"varnish_instance"}
+}
+
+// Targets returns the instances found by the last discovery, discovering again if -discovery.interval has passed.
+func (s *discoverySource) Targets(ctx context.Context) ([]*scrapeTarget, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.discovered.IsZero() || time.Now().Sub(s.discovered) >= s.interval {
+		s.discover(ctx)
+		s.discovered = time.Now()
+	}
+	targets := []*scrapeTarget{}
+	for _, target := range s.targets {
+		targets = append(targets, target)
+	}
+	return sortTargets(targets), nil
+}
+
+func (s *discoverySource) discover(ctx context.Context) {
+	found := make(map[string]bool)
+	for _, workdir := range s.scanStateDirs() {
+		found[workdir] = true
+	}
+	for _, workdir := range s.scanProcesses() {
+		found[workdir] = true
+	}
+
+	current := make(map[string]*scrapeTarget)
+	for workdir := range found {
+		target := s.targets[workdir]
+		if target == nil {
+			name := s.instanceName(workdir)
+			target = newScrapeTarget(name, s.LabelKeys(), []string{name}, localExecutor())
+			target.params = &varnishstatParams{Instance: workdir, VSM: StartParams.Params.VSM}
+			logScrape.InfoContext(ctx, "Discovered varnishd instance", "varnish_instance", name, "workdir", workdir)
+		}
+		current[workdir] = target
+	}
+	for workdir, target := range s.targets {
+		if current[workdir] == nil {
+			logScrape.InfoContext(ctx, "Varnishd instance is gone", "varnish_instance", target.name, "workdir", workdir)
+		}
+	}
+	s.targets = current
+}
+
+// Returns the working directories with live VSM segments. Varnish 5.0+ writes the
+// manager pid to the first line of _.vsm_mgt/_.index, "# <pid> <birth time>".
+// Varnish 4 instances are found from /proc only.
+func (s *discoverySource) scanStateDirs() []string {
+	candidates := []string{}
+	for _, stateDir := range s.stateDirs {
+		entries, err := ioutil.ReadDir(stateDir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				candidates = append(candidates, filepath.Join(stateDir, entry.Name()))
+			}
+		}
+	}
+	if n := s.getenv("VARNISH_DEFAULT_N"); n != "" {
+		candidates = append(candidates, s.workdir(n))
+	}
+
+	workdirs := []string{}
+	for _, workdir := range candidates {
+		f, err := os.Open(filepath.Join(workdir, "_.vsm_mgt", "_.index"))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		if scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) >= 2 && fields[0] == "#" && s.processExists(fields[1]) {
+				workdirs = append(workdirs, workdir)
+			}
+		}
+		f.Close()
+	}
+	return workdirs
+}
+
+// Returns the working directories of running varnishd processes.
+func (s *discoverySource) scanProcesses() []string {
+	entries, err := ioutil.ReadDir(s.procDir)
+	if err != nil {
+		return nil
+	}
+	workdirs := []string{}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		cmdline, err := ioutil.ReadFile(filepath.Join(s.procDir, entry.Name(), "cmdline"))
+		if err != nil || len(cmdline) == 0 {
+			continue
+		}
+		args := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+		if filepath.Base(args[0]) != "varnishd" {
+			continue
+		}
+		n, ok := varnishdInstanceArg(args[1:])
+		if !ok {
+			// Not a daemon, e.g. varnishd -C or -V
+			continue
+		}
+		if n == "" {
+			n = s.processEnv(entry.Name(), "VARNISH_DEFAULT_N")
+		}
+		if n == "" {
+			n = s.defaultWorkdir()
+		}
+		workdirs = append(workdirs, s.workdir(n))
+	}
+	return workdirs
+}
+
+// Returns the -n argument of varnishd, empty if not given. False if the arguments
+// are for a one-off command instead of running varnishd.
+func varnishdInstanceArg(args []string) (string, bool) {
+	n := ""
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-C", arg == "-V", arg == "-?", arg == "-x":
+			return "", false
+		case arg == "-n" && i+1 < len(args):
+			n = args[i+1]
+			i++
+		case strings.HasPrefix(arg, "-n") && len(arg) > 2:
+			n = arg[2:]
+		}
+	}
+	return n, true
+}
+
+// Relative instance names are in the first state directory, as varnishd resolves them.
+func (s *discoverySource) workdir(n string) string {
+	if filepath.IsAbs(n) {
+		return filepath.Clean(n)
+	}
+	return filepath.Join(s.stateDirs[0], n)
+}
+
+// Returns the default working directory of varnishd. Varnish 6.6+ defaults to "varnishd",
+// older versions to the hostname.
+func (s *discoverySource) defaultWorkdir() string {
+	for _, n := range []string{"varnishd", s.hostname} {
+		if workdir := s.workdir(n); n != "" && fileExists(workdir) {
+			return workdir
+		}
+	}
+	return s.workdir(s.hostname)
+}
+
+// Returns the varnish_instance label value. Working directories in the first
+// state directory are named like in -n, others by path.
+func (s *discoverySource) instanceName(workdir string) string {
+	if filepath.Dir(workdir) == s.stateDirs[0] {
+		return filepath.Base(workdir)
+	}
+	return workdir
+}
+
+func (s *discoverySource) processExists(pid string) bool {
+	if _, err := strconv.Atoi(pid); err != nil {
+		return false
+	}
+	return fileExists(filepath.Join(s.procDir, pid))
+}
+
+// Returns an environment variable of a process. Reading other users' process environment needs privileges.
+func (s *discoverySource) processEnv(pid, key string) string {
+	environ, err := ioutil.ReadFile(filepath.Join(s.procDir, pid, "environ"))
+	if err != nil {
+		return ""
+	}
+	for _, kv := range strings.Split(string(environ), "\x00") {
+		if strings.HasPrefix(kv, key+"=") {
+			return kv[len(key)+1:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_VarnishdInstanceArg(t *testing.T) {
+	for _, test := range []struct {
+		args     string
+		n        string
+		isDaemon bool
+	}{
+		{"-a :80 -f /etc/varnish/default.vcl", "", true},
+		{"-a :80 -n edge -s malloc,1G", "edge", true},
+		{"-F -n/srv/varnish/api", "/srv/varnish/api", true},
+		{"-C -f /etc/varnish/default.vcl", "", false},
+		{"-V", "", false},
+	} {
+		n, isDaemon := varnishdInstanceArg(strings.Fields(test.args))
+		if n != test.n || isDaemon != test.isDaemon {
+			t.Errorf("%q: got %q %v, expected %q %v", test.args, n, isDaemon, test.n, test.isDaemon)
+		}
+	}
+}
+
+func Test_DiscoverySource(t *testing.T) {
+	root := t.TempDir()
+	stateDir, procDir := filepath.Join(root, "state"), filepath.Join(root, "proc")
+
+	// Live VSM segment with its manager process, a stale one and a Varnish 4 instance found from /proc
+	writeTestFile(t, filepath.Join(stateDir, "varnishd", "_.vsm_mgt", "_.index"), "# 100 1600000000\n")
+	writeTestFile(t, filepath.Join(procDir, "100", "cmdline"), "/usr/sbin/varnishd\x00-a\x00:80\x00")
+	writeTestFile(t, filepath.Join(stateDir, "stale", "_.vsm_mgt", "_.index"), "# 999 1600000000\n")
+	writeTestFile(t, filepath.Join(procDir, "200", "cmdline"), "varnishd\x00-n\x00legacy\x00-a\x00:8080\x00")
+	writeTestFile(t, filepath.Join(procDir, "201", "cmdline"), "varnishd\x00-n\x00legacy\x00-a\x00:8080\x00")
+	writeTestFile(t, filepath.Join(procDir, "300", "cmdline"), "varnishd\x00-C\x00-f\x00test.vcl\x00")
+	writeTestFile(t, filepath.Join(procDir, "400", "cmdline"), "/usr/sbin/nginx\x00")
+	// Outside the state directory, from the environment of the process
+	writeTestFile(t, filepath.Join(procDir, "500", "cmdline"), "varnishd\x00-a\x00:81\x00")
+	writeTestFile(t, filepath.Join(procDir, "500", "environ"), "HOME=/\x00VARNISH_DEFAULT_N=/srv/varnish/api\x00")
+
+	source := newDiscoverySource(&discoveryParams{Interval: time.Hour, StateDirs: stateDir})
+	source.procDir = procDir
+
+	names := func() map[string]string {
+		targets, err := source.Targets(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make(map[string]string)
+		for _, target := range targets {
+			if len(target.labelValues) != 1 || target.labelValues[0] != target.name {
+				t.Errorf("unexpected label values %v", target.labelValues)
+			}
+			names[target.name] = target.params.Instance
+		}
+		return names
+	}
+	found := names()
+	t.Logf("discovered %v", found)
+	expected := map[string]string{
+		"varnishd":         filepath.Join(stateDir, "varnishd"),
+		"legacy":           filepath.Join(stateDir, "legacy"),
+		"/srv/varnish/api": "/srv/varnish/api",
+	}
+	if len(found) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, found)
+	}
+	for name, workdir := range expected {
+		if found[name] != workdir {
+			t.Errorf("%s: expected -n %q, got %q", name, workdir, found[name])
+		}
+	}
+
+	// Not discovered again before the interval
+	os.RemoveAll(filepath.Join(procDir, "200"))
+	os.RemoveAll(filepath.Join(procDir, "201"))
+	if found := names(); len(found) != 3 {
+		t.Errorf("discovered before interval: %v", found)
+	}
+	source.discovered = time.Now().Add(-2 * time.Hour)
+	if found := names(); len(found) != 2 || found["legacy"] != "" {
+		t.Errorf("stopped instance not removed: %v", found)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	dockerDefaultSocket = "/var/run/docker.sock"
+	podmanDefaultSocket = "/run/podman/podman.sock"
+	// Stream types in the multiplexed exec output when no TTY is allocated
+	dockerStdout = 1
+	dockerStderr = 2
+)
+
+type dockerParams struct {
+	Host            string
+	ContainerName   string
+	LabelSelector   string
+	ContainerLabels string
+}
+
+func (p *dockerParams) enabled() bool {
+	return p.ContainerName != "" || p.LabelSelector != ""
+}
+
+// Returns the Docker or Podman API address. -docker.host and DOCKER_HOST take precedence,
+// then the first existing socket of Docker, rootful Podman and rootless Podman.
+func (p *dockerParams) host() string {
+	if p.Host != "" {
+		return p.Host
+	}
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		return host
+	}
+	sockets := []string{dockerDefaultSocket, podmanDefaultSocket}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	for _, socket := range sockets {
+		if fileExists(socket) {
+			return "unix://" + socket
+		}
+	}
+	return "unix://" + dockerDefaultSocket
+}
+
+// dockerClient talks to the Docker Engine API, or the compatible Podman API,
+// over a unix socket or TCP.
+type dockerClient struct {
+	base   string
+	client *http.Client
+}
+
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("-docker.host: %s", err)
+	}
+	transport := &http.Transport{}
+	c := &dockerClient{client: &http.Client{Transport: transport}}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		// Host is not used for unix sockets but must be a valid name
+		c.base = "http://docker"
+	case "tcp", "https":
+		// Plain HTTP for tcp:// unless the TLS environment of the docker CLI is set
+		tlsConfig, err := dockerTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig == nil && u.Scheme == "tcp" {
+			c.base = "http://" + u.Host
+			break
+		}
+		transport.TLSClientConfig = tlsConfig
+		c.base = "https://" + u.Host
+	case "http":
+		c.base = "http://" + u.Host
+	default:
+		return nil, fmt.Errorf("-docker.host must be a unix, tcp, http or https URL, given %q", host)
+	}
+	return c, nil
+}
+
+// Returns the TLS configuration from DOCKER_TLS_VERIFY and DOCKER_CERT_PATH like the docker CLI
+// and SDK, nil if neither is set. The ca.pem, cert.pem and key.pem files are read from DOCKER_CERT_PATH,
+// ~/.docker by default, the server certificate is only verified if DOCKER_TLS_VERIFY is not empty.
+func dockerTLSConfig() (*tls.Config, error) {
+	verify, certPath := os.Getenv("DOCKER_TLS_VERIFY"), os.Getenv("DOCKER_CERT_PATH")
+	if verify == "" && certPath == "" {
+		return nil, nil
+	}
+	if certPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("DOCKER_CERT_PATH is not set and the home directory is unknown: %s", err)
+		}
+		certPath = filepath.Join(home, ".docker")
+	}
+	pem, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Docker TLS CA certificate: %s", err)
+	}
+	config := &tls.Config{RootCAs: x509.NewCertPool(), InsecureSkipVerify: verify == ""}
+	if !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("Docker TLS CA certificate: no certificates found in %s", filepath.Join(certPath, "ca.pem"))
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Docker TLS client certificate: %s", err)
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// https://docs.docker.com/engine/api/v1.41/#operation/ContainerList
+// Only the fields we use.
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+}
+
+func (c *dockerContainer) name() string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// Sends a request with an optional JSON body and decodes the JSON response to result if not nil.
+func (c *dockerClient) do(ctx context.Context, method, path string, body, result interface{}) error {
+	resp, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *dockerClient) request(ctx context.Context, method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		message := struct {
+			Message string `json:"message"`
+		}{}
+		if err := json.NewDecoder(resp.Body).Decode(&message); err == nil && message.Message != "" {
+			return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, message.Message)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Lists the running containers that have all the given labels, "key" or "key=value".
+func (c *dockerClient) containers(ctx context.Context, labels []string) ([]dockerContainer, error) {
+	filters, err := json.Marshal(map[string][]string{
+		"label":  labels,
+		"status": {"running"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	containers := []dockerContainer{}
+	err = c.do(ctx, http.MethodGet, "/containers/json?filters="+url.QueryEscape(string(filters)), nil, &containers)
+	return containers, err
+}
+
+// Runs command in the container without a TTY. Returns stdout on success, stderr and stdout on failure.
+// The command keeps running in the container if ctx is done, the API has no way to kill it.
+func (c *dockerClient) exec(ctx context.Context, container string, command []string) (*bytes.Buffer, error) {
+	created := struct {
+		ID string `json:"Id"`
+	}{}
+	err := c.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(container)+"/exec", map[string]interface{}{
+		"AttachStdout": true,
+		"AttachStderr": true,
+		"Tty":          false,
+		"Cmd":          command,
+	}, &created)
+	if err != nil {
+		return &bytes.Buffer{}, fmt.Errorf("exec in container %s failed: %s", container, err)
+	}
+
+	resp, err := c.request(ctx, http.MethodPost, "/exec/"+created.ID+"/start", map[string]interface{}{
+		"Detach": false,
+		"Tty":    false,
+	})
+	if err != nil {
+		return &bytes.Buffer{}, fmt.Errorf("exec in container %s failed: %s", container, err)
+	}
+	defer resp.Body.Close()
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := demultiplexDockerStream(resp.Body, stdout, stderr); err != nil {
+		stderr.Write(stdout.Bytes())
+		return stderr, err
+	}
+
+	inspect := struct {
+		ExitCode int `json:"ExitCode"`
+	}{}
+	if err := c.do(ctx, http.MethodGet, "/exec/"+created.ID+"/json", nil, &inspect); err != nil {
+		stderr.Write(stdout.Bytes())
+		return stderr, err
+	}
+	if inspect.ExitCode != 0 {
+		stderr.Write(stdout.Bytes())
+		return stderr, fmt.Errorf("exit status %d", inspect.ExitCode)
+	}
+	return stdout, nil
+}
+
+// Splits the exec output stream to stdout and stderr. Each frame has an 8 byte header
+// of the stream type, 3 zero bytes and the big endian uint32 size of the payload.
+func demultiplexDockerStream(r io.Reader, stdout, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var w io.Writer
+		switch header[0] {
+		case dockerStdout:
+			w = stdout
+		case dockerStderr:
+			w = stderr
+		default:
+			w = io.Discard
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// dockerSource scrapes varnishstat in a single named container, or in the running
+// containers matching -docker.label-selector, through the Docker Engine API.
+// In label mode the metrics are labeled with the container name and optionally
+// container labels.
+type dockerSource struct {
+	sync.Mutex
+
+	params          *dockerParams
+	client          *dockerClient
+	selector        []string
+	containerLabels []string // container label names, in labelKeys order after container
+	labelKeys       []string
+	targets         map[string]*dockerTarget // by container name
+}
+
+type dockerTarget struct {
+	*scrapeTarget
+	id string
+}
+
+func newDockerSource(params *dockerParams) (*dockerSource, error) {
+	if params.ContainerName != "" && params.LabelSelector != "" {
+		return nil, fmt.Errorf("-docker-container-name and -docker.label-selector cannot be used together")
+	}
+	client, err := newDockerClient(params.host())
+	if err != nil {
+		return nil, err
+	}
+	s := &dockerSource{
+		params:  params,
+		client:  client,
+		targets: make(map[string]*dockerTarget),
+	}
+	if params.LabelSelector != "" {
+		for _, label := range strings.Split(params.LabelSelector, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				s.selector = append(s.selector, label)
+			}
+		}
+		s.labelKeys = []string{"container"}
+		for _, label := range strings.Split(params.ContainerLabels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				s.containerLabels = append(s.containerLabels, label)
+				s.labelKeys = append(s.labelKeys, "label_"+sanitizeLabelName(label))
+			}
+		}
+	}
+	return s, nil
+}
+
+func (s *dockerSource) LabelKeys() []string {
+	return s.labelKeys
+}
+
+// Targets returns the -docker-container-name container, or lists the
+// running containers matching the label selector.
+func (s *dockerSource) Targets(ctx context.Context) ([]*scrapeTarget, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.params.ContainerName != "" {
+		// Unlabeled like the local source, the container is addressed by name
+		target := s.target(dockerContainer{ID: s.params.ContainerName, Names: []string{s.params.ContainerName}})
+		s.targets[target.name] = target
+		return []*scrapeTarget{target.scrapeTarget}, nil
+	}
+
+	containers, err := s.client.containers(ctx, s.selector)
+	if err != nil {
+		return nil, fmt.Errorf("listing containers failed: %s", err)
+	}
+	current := make(map[string]*dockerTarget)
+	targets := []*scrapeTarget{}
+	for _, container := range containers {
+		target := s.target(container)
+		current[target.name] = target
+		targets = append(targets, target.scrapeTarget)
+	}
+	s.targets = current
+	return targets, nil
+}
+
+// Returns the existing target for the container, or a new one if the container was recreated.
+func (s *dockerSource) target(container dockerContainer) *dockerTarget {
+	name := container.name()
+	if target := s.targets[name]; target != nil && target.id == container.ID {
+		return target
+	}
+	var labelValues []string
+	if len(s.labelKeys) > 0 {
+		labelValues = []string{name}
+		for _, label := range s.containerLabels {
+			labelValues = append(labelValues, container.Labels[label])
+		}
+	}
+	id := container.ID
+	exec := func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+		return s.client.exec(ctx, id, append([]string{exe}, params...))
+	}
+	return &dockerTarget{
+		scrapeTarget: newScrapeTarget(name, s.labelKeys, labelValues, exec),
+		id:           id,
+	}
+}
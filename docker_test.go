@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func dockerFrame(stream byte, data string) []byte {
+	frame := make([]byte, 8, 8+len(data))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(data)))
+	return append(frame, data...)
+}
+
+// Fake Docker Engine API on a unix socket with two running varnish containers, one of them broken.
+func newFakeDockerAPI(t *testing.T) string {
+	dir, _ := os.Getwd()
+	stats, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape/6.5.1.json"))
+	if err != nil {
+		t.Skipf("Cannot read test file: %s", err)
+	}
+	var mu sync.Mutex
+	execs := make(map[string][]string) // exec id -> container id, command
+	containers := `[
+		{"Id": "aaa", "Names": ["/varnish-a"], "Labels": {"app": "varnish", "tier": "edge"}},
+		{"Id": "bbb", "Names": ["/varnish-b"], "Labels": {"app": "varnish"}}
+	]`
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, r *http.Request) {
+		filters := make(map[string][]string)
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil {
+			t.Error(err)
+		}
+		if strings.Join(filters["label"], ",") != "app=varnish" || strings.Join(filters["status"], ",") != "running" {
+			t.Errorf("unexpected filters %v", filters)
+		}
+		w.Write([]byte(containers))
+	})
+	mux.HandleFunc("/containers/", func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Tty bool
+			Cmd []string
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		if body.Tty {
+			t.Error("exec with TTY")
+		}
+		id := strings.Split(r.URL.Path, "/")[2]
+		mu.Lock()
+		execID := fmt.Sprintf("exec-%s-%d", id, len(execs))
+		execs[execID] = append([]string{id}, body.Cmd...)
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"Id": "` + execID + `"}`))
+	})
+	mux.HandleFunc("/exec/", func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		mu.Lock()
+		exec := execs[parts[2]]
+		mu.Unlock()
+		if exec == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "No such exec instance"}`))
+			return
+		}
+		broken := exec[0] == "bbb"
+		if parts[3] == "json" {
+			if broken {
+				w.Write([]byte(`{"ExitCode": 1}`))
+			} else {
+				w.Write([]byte(`{"ExitCode": 0}`))
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.docker.multiplexed-stream")
+		command := strings.Join(exec[1:], " ")
+		switch {
+		case broken:
+			w.Write(dockerFrame(dockerStderr, "Could not get hold of varnishd, is it running?\n"))
+		case command == "varnishstat -V":
+			w.Write(dockerFrame(dockerStdout, "varnishstat (varnish-6.5.1 revision 1dae23376bb5ea7a6b8e9e4b9ed95cdc9469fb64)\n"))
+		case strings.HasPrefix(command, "varnishstat -j"):
+			// Large output is split to several frames
+			half := len(stats) / 2
+			w.Write(dockerFrame(dockerStdout, string(stats[:half])))
+			w.Write(dockerFrame(dockerStderr, "warning\n"))
+			w.Write(dockerFrame(dockerStdout, string(stats[half:])))
+		default:
+			t.Errorf("unexpected command %q", command)
+		}
+	})
+
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("Cannot listen on unix socket: %s", err)
+	}
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return "unix://" + socket
+}
+
+func Test_DockerSource(t *testing.T) {
+	host := newFakeDockerAPI(t)
+	source, err := newDockerSource(&dockerParams{
+		Host:            host,
+		LabelSelector:   "app=varnish",
+		ContainerLabels: "tier",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewPrometheusExporter()
+	if err := exporter.Initialize(source); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	labels := func(m *dto.Metric) map[string]string {
+		labels := make(map[string]string)
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		return labels
+	}
+
+	up := map[string]float64{}
+	for _, m := range byName["varnish_up"].GetMetric() {
+		up[labels(m)["container"]] = m.GetGauge().GetValue()
+	}
+	t.Logf("varnish_up %v", up)
+	if len(up) != 2 || up["varnish-a"] != 1 || up["varnish-b"] != 0 {
+		t.Errorf("unexpected varnish_up %v", up)
+	}
+	happy := byName["varnish_backend_happy"]
+	if happy == nil || len(happy.GetMetric()) == 0 {
+		t.Fatal("varnish_backend_happy not exported")
+	}
+	for _, m := range happy.GetMetric() {
+		if l := labels(m); l["container"] != "varnish-a" || l["label_tier"] != "edge" {
+			t.Errorf("unexpected labels %v", l)
+		}
+	}
+
+	// Fixed container name, unlabeled like the local source
+	source, err = newDockerSource(&dockerParams{Host: host, ContainerName: "aaa"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := source.Targets(exporter.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 1 || len(targets[0].labelKeys) != 0 {
+		t.Fatalf("unexpected targets %v", targets)
+	}
+	buf, err := targets[0].exec(exporter.ctx, "varnishstat", "-V")
+	if err != nil || strings.Contains(buf.String(), "\r") {
+		t.Errorf("unexpected exec output %q: %v", buf, err)
+	}
+}
+
+// Writes a self-signed certificate for 127.0.0.1 to dir as ca.pem, cert.pem and key.pem.
+func writeDockerTestCerts(t *testing.T, dir string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "docker"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	for name, content := range map[string][]byte{"ca.pem": certPEM, "cert.pem": certPEM, "key.pem": keyPEM} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// A tcp:// DOCKER_HOST uses TLS with the DOCKER_TLS_VERIFY and DOCKER_CERT_PATH of the docker CLI.
+func Test_DockerTLS(t *testing.T) {
+	certPath := t.TempDir()
+	cert := writeDockerTestCerts(t, certPath)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"Id": "aaa", "Names": ["/varnish-a"]}]`))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	host := "tcp://" + server.Listener.Addr().String()
+
+	t.Setenv("DOCKER_TLS_VERIFY", "1")
+	t.Setenv("DOCKER_CERT_PATH", certPath)
+	client, err := newDockerClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers, err := client.containers(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].name() != "varnish-a" {
+		t.Errorf("unexpected containers %v", containers)
+	}
+
+	// Missing certificates fail with the file that is missing
+	t.Setenv("DOCKER_CERT_PATH", t.TempDir())
+	if _, err := newDockerClient(host); err == nil || !strings.Contains(err.Error(), "ca.pem") {
+		t.Errorf("expected ca.pem error, got %v", err)
+	}
+
+	// Plain HTTP without the TLS environment
+	t.Setenv("DOCKER_TLS_VERIFY", "")
+	t.Setenv("DOCKER_CERT_PATH", "")
+	client, err = newDockerClient(host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.base != "http://"+server.Listener.Addr().String() {
+		t.Errorf("unexpected base %s", client.base)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Starts the exporter HTTP server with the local source, scraping the fake varnishstat.
+func newTestExporterServer(t *testing.T) *httptest.Server {
+	previousExporter, previousVersion, previousCache := PrometheusExporter, VarnishVersion, DescCache
+	PrometheusExporter, VarnishVersion, DescCache = NewPrometheusExporter(), NewVarnishVersion(), newDescCache()
+	if err := PrometheusExporter.Initialize(newLocalSource()); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(newServeMux())
+	t.Cleanup(func() {
+		server.Close()
+		PrometheusExporter, VarnishVersion, DescCache = previousExporter, previousVersion, previousCache
+	})
+	return server
+}
+
+// Returns the parsed /metrics of server.
+func getTestMetrics(t *testing.T, server *httptest.Server) map[string]*dto.MetricFamily {
+	families, err := fetchTestMetrics(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families
+}
+
+func fetchTestMetrics(server *httptest.Server) (map[string]*dto.MetricFamily, error) {
+	resp, err := http.Get(server.URL + StartParams.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d: %s", resp.StatusCode, body)
+	}
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid exposition: %s\n%s", err, body)
+	}
+	return families, nil
+}
+
+func familyText(t *testing.T, family *dto.MetricFamily) string {
+	buf := &bytes.Buffer{}
+	if _, err := expfmt.MetricFamilyToText(buf, family); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func Test_EndToEnd(t *testing.T) {
+	dir, _ := os.Getwd()
+	if !fileExists(filepath.Join(dir, "test/scrape")) {
+		t.Skipf("Cannot find test/scrape files from working dir %s", dir)
+	}
+	for _, version := range testFileVersions {
+		t.Run(version, func(t *testing.T) {
+			fixture := filepath.Join(dir, "test/scrape", version+".json")
+			setFakeVarnishstat(t, fakeVarnishstatOK, fixtureVersion(version), fixture)
+			server := newTestExporterServer(t)
+
+			families := getTestMetrics(t, server)
+			if value := families["varnish_up"].GetMetric()[0].GetGauge().GetValue(); value != 1 {
+				t.Fatalf("varnish_up %v", value)
+			}
+			labels := make(map[string]string)
+			for _, label := range families["varnish_version"].GetMetric()[0].GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			t.Logf("varnish_version %v", labels)
+			if expected := strings.Join(strings.Split(fixtureVersion(version), ".")[:2], "."); labels["major"]+"."+labels["minor"] != expected {
+				t.Errorf("expected version %s, got %v", expected, labels)
+			}
+
+			// The varnishstat metrics are the same as scraped from the file directly
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(&testCollector{filepath: fixture, t: t})
+			expected, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, family := range expected {
+				served, ok := families[family.GetName()]
+				if !ok {
+					t.Errorf("%s: missing from /metrics", family.GetName())
+					continue
+				}
+				if got, want := familyText(t, served), familyText(t, family); got != want {
+					t.Errorf("%s: served\n%s\nexpected\n%s", family.GetName(), got, want)
+				}
+			}
+			t.Logf("%d metric families", len(families))
+		})
+	}
+}
+
+func Test_EndToEndFailures(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixture := filepath.Join(dir, "test/scrape/6.5.1.json")
+	for _, mode := range []string{fakeVarnishstatFail, fakeVarnishstatGarbage} {
+		t.Run(mode, func(t *testing.T) {
+			setFakeVarnishstat(t, mode, "6.5.1", fixture)
+			server := newTestExporterServer(t)
+
+			families := getTestMetrics(t, server)
+			if value := families["varnish_up"].GetMetric()[0].GetGauge().GetValue(); value != 0 {
+				t.Errorf("varnish_up %v", value)
+			}
+			if _, ok := families["varnish_main_uptime"]; ok {
+				t.Error("varnishstat metrics from a failed scrape")
+			}
+		})
+	}
+
+	t.Run(fakeVarnishstatHang, func(t *testing.T) {
+		setFakeVarnishstat(t, fakeVarnishstatHang, "6.5.1", fixture)
+		server := newTestExporterServer(t)
+
+		scraped := make(chan map[string]*dto.MetricFamily, 1)
+		go func() {
+			families, err := fetchTestMetrics(server)
+			if err != nil {
+				t.Error(err)
+			}
+			scraped <- families
+		}()
+		// Abort kills the hanging varnishstat, the scrape returns with varnish_up 0
+		time.Sleep(500 * time.Millisecond)
+		PrometheusExporter.Abort(5 * time.Second)
+		select {
+		case families := <-scraped:
+			if value := families["varnish_up"].GetMetric()[0].GetGauge().GetValue(); value != 0 {
+				t.Errorf("varnish_up %v", value)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("hanging varnishstat was not killed")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		setFakeVarnishstat(t, fakeVarnishstatHang, "6.5.1", fixture)
+		previous := StartParams.ScrapeTimeout
+		StartParams.ScrapeTimeout = 500 * time.Millisecond
+		t.Cleanup(func() { StartParams.ScrapeTimeout = previous })
+		server := newTestExporterServer(t)
+
+		// -scrape.timeout kills the hanging varnishstat without Abort
+		start := time.Now()
+		families := getTestMetrics(t, server)
+		if value := families["varnish_up"].GetMetric()[0].GetGauge().GetValue(); value != 0 {
+			t.Errorf("varnish_up %v", value)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("scrape took %s with -scrape.timeout %s", elapsed, StartParams.ScrapeTimeout)
+		}
+	})
+}
+
+// Version detection from varnishstat -V and the arguments of each version
+func Test_FakeVarnishstatVersions(t *testing.T) {
+	for _, version := range testFileVersions {
+		setFakeVarnishstat(t, fakeVarnishstatOK, fixtureVersion(version), "")
+		v := NewVarnishVersion()
+		if err := v.queryVersion(context.Background(), executeVarnishTool); err != nil {
+			t.Fatalf("%s: %s", version, err)
+		}
+		if got := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch); !strings.HasPrefix(fixtureVersion(version), got) {
+			t.Errorf("expected version %s, got %s", version, got)
+		}
+		if v.Revision != "0123456789abcdef0123456789abcdef01234567" {
+			t.Errorf("%s: unexpected revision %q", version, v.Revision)
+		}
+	}
+}
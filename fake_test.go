@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test binary runs as a fake varnishstat when FAKE_VARNISHSTAT is set,
+// replaying the FAKE_VARNISHSTAT_FIXTURE file. Use setFakeVarnishstat in tests.
+const (
+	fakeVarnishstatEnv        = "FAKE_VARNISHSTAT"
+	fakeVarnishstatFixtureEnv = "FAKE_VARNISHSTAT_FIXTURE"
+	fakeVarnishstatVersionEnv = "FAKE_VARNISHSTAT_VERSION"
+)
+
+// Modes of the fake varnishstat
+const (
+	fakeVarnishstatOK      = "ok"
+	fakeVarnishstatFail    = "fail"    // varnishd not running
+	fakeVarnishstatHang    = "hang"    // never exits
+	fakeVarnishstatGarbage = "garbage" // not JSON
+)
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(fakeVarnishstatEnv); mode != "" {
+		os.Exit(fakeVarnishstat(mode, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// Sets the test binary as the varnishstat of the test, replaying fixture as version.
+func setFakeVarnishstat(t *testing.T, mode, version, fixture string) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(fakeVarnishstatEnv, mode)
+	t.Setenv(fakeVarnishstatVersionEnv, version)
+	t.Setenv(fakeVarnishstatFixtureEnv, fixture)
+	previous := StartParams.VarnishstatExe
+	StartParams.VarnishstatExe = exe
+	t.Cleanup(func() { StartParams.VarnishstatExe = previous })
+}
+
+// Fake varnishstat main, returns the exit code.
+func fakeVarnishstat(mode string, args []string) int {
+	version := os.Getenv(fakeVarnishstatVersionEnv)
+	if len(args) == 1 && args[0] == "-V" {
+		product := "varnish"
+		if strings.Contains(version, "r") {
+			product = "varnish-plus"
+		}
+		fmt.Fprintf(os.Stderr, "varnishstat (%s-%s revision 0123456789abcdef0123456789abcdef01234567)\n", product, version)
+		fmt.Fprintf(os.Stderr, "Copyright (c) 2006 Verdens Gang AS\n")
+		return 0
+	}
+
+	// -t is supported from 4.1, older versions exit on unknown options
+	expected := "-j"
+	fakeVersion := NewVarnishVersion()
+	if err := fakeVersion.parseVersion(version); err == nil && fakeVersion.EqualsOrGreater(4, 1) {
+		expected = "-j -t 0"
+	}
+	if got := strings.Join(args, " "); !strings.HasPrefix(got, expected) {
+		fmt.Fprintf(os.Stderr, "varnishstat: unexpected arguments %q, expected %q\n", got, expected)
+		return 1
+	}
+
+	switch mode {
+	case fakeVarnishstatFail:
+		fmt.Fprintln(os.Stderr, "Could not get hold of varnishd, is it running?")
+		return 1
+	case fakeVarnishstatHang:
+		time.Sleep(time.Hour)
+		return 1
+	case fakeVarnishstatGarbage:
+		fmt.Fprintln(os.Stdout, "<html><body>502 Bad Gateway</body></html>")
+		return 0
+	}
+	buf, err := ioutil.ReadFile(os.Getenv(fakeVarnishstatFixtureEnv))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(buf)
+	return 0
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var updateGolden = flag.Bool("update", false, "Update the golden files in test/golden from test/scrape")
+
+// goldenFamily is a metric family without values, the names, labels, type and help
+// of the series exported from a test/scrape file.
+type goldenFamily struct {
+	name   string
+	help   string
+	typ    string
+	series []string
+}
+
+func goldenFamilies(families []*dto.MetricFamily) []*goldenFamily {
+	var golden []*goldenFamily
+	for _, family := range families {
+		g := &goldenFamily{
+			name: family.GetName(),
+			help: family.GetHelp(),
+			typ:  strings.ToLower(family.GetType().String()),
+		}
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, label := range m.GetLabel() {
+				labels = append(labels, fmt.Sprintf("%s=%q", label.GetName(), label.GetValue()))
+			}
+			sort.Strings(labels)
+			g.series = append(g.series, family.GetName()+"{"+strings.Join(labels, ",")+"}")
+		}
+		sort.Strings(g.series)
+		golden = append(golden, g)
+	}
+	sort.Slice(golden, func(i, j int) bool {
+		return golden[i].name < golden[j].name
+	})
+	return golden
+}
+
+func formatGolden(families []*goldenFamily) string {
+	var b strings.Builder
+	for _, family := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.typ)
+		for _, series := range family.series {
+			fmt.Fprintln(&b, series)
+		}
+	}
+	return b.String()
+}
+
+func parseGolden(text string) ([]*goldenFamily, error) {
+	var (
+		families []*goldenFamily
+		current  *goldenFamily
+	)
+	for i, line := range strings.Split(strings.TrimSpace(text), "\n") {
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			fields := strings.SplitN(line, " ", 4)
+			current = &goldenFamily{name: fields[2]}
+			if len(fields) == 4 {
+				current.help = fields[3]
+			}
+			families = append(families, current)
+		case strings.HasPrefix(line, "# TYPE ") && current != nil:
+			current.typ = line[len("# TYPE "+current.name+" "):]
+		case current != nil && strings.HasPrefix(line, current.name+"{"):
+			current.series = append(current.series, line)
+		case line == "":
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", i+1, line)
+		}
+	}
+	return families, nil
+}
+
+// Returns the differences between the expected and actual families, one per line.
+// Families removed and added with the same help, type and number of series are
+// reported as renamed.
+func diffGolden(expected, actual []*goldenFamily) []string {
+	expectedByName := make(map[string]*goldenFamily)
+	for _, family := range expected {
+		expectedByName[family.name] = family
+	}
+	actualByName := make(map[string]*goldenFamily)
+	for _, family := range actual {
+		actualByName[family.name] = family
+	}
+
+	var removed, added []*goldenFamily
+	for _, family := range expected {
+		if actualByName[family.name] == nil {
+			removed = append(removed, family)
+		}
+	}
+	for _, family := range actual {
+		if expectedByName[family.name] == nil {
+			added = append(added, family)
+		}
+	}
+
+	var diff []string
+	renamed := make(map[*goldenFamily]bool)
+	for _, from := range removed {
+		for _, to := range added {
+			if !renamed[to] && from.help == to.help && from.typ == to.typ && len(from.series) == len(to.series) {
+				diff = append(diff, fmt.Sprintf("renamed %s -> %s", from.name, to.name))
+				renamed[from], renamed[to] = true, true
+				break
+			}
+		}
+	}
+	for _, family := range removed {
+		if !renamed[family] {
+			diff = append(diff, fmt.Sprintf("removed %s (%d series)", family.name, len(family.series)))
+		}
+	}
+	for _, family := range added {
+		if !renamed[family] {
+			diff = append(diff, fmt.Sprintf("added %s (%d series)", family.name, len(family.series)))
+		}
+	}
+
+	for _, from := range expected {
+		to := actualByName[from.name]
+		if to == nil {
+			continue
+		}
+		if from.typ != to.typ {
+			diff = append(diff, fmt.Sprintf("type of %s changed %s -> %s", from.name, from.typ, to.typ))
+		}
+		if from.help != to.help {
+			diff = append(diff, fmt.Sprintf("help of %s changed %q -> %q", from.name, from.help, to.help))
+		}
+		series := make(map[string]bool)
+		for _, s := range to.series {
+			series[s] = true
+		}
+		for _, s := range from.series {
+			if !series[s] {
+				diff = append(diff, "- "+s)
+			}
+			delete(series, s)
+		}
+		for _, s := range to.series {
+			if series[s] {
+				diff = append(diff, "+ "+s)
+			}
+		}
+	}
+	return diff
+}
+
+func Test_GoldenExposition(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixtures, _ := filepath.Glob(filepath.Join(dir, "test/scrape/*.json"))
+	if len(fixtures) == 0 {
+		t.Skipf("Cannot find test/scrape files from working dir %s", dir)
+	}
+	// The help of a cached desc is from the first version scraped, an exporter only scrapes one
+	previousCache := DescCache
+	defer func() { DescCache = previousCache }()
+	for _, fixture := range fixtures {
+		DescCache = newDescCache()
+		version := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		golden := filepath.Join(dir, "test/golden", version+".txt")
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(&testCollector{filepath: fixture, t: t})
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := goldenFamilies(families)
+
+		if *updateGolden {
+			if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(golden, []byte(formatGolden(actual)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("Updated %s", golden)
+			continue
+		}
+
+		buf, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: %s, run go test -run Test_GoldenExposition -update to create it", version, err)
+			continue
+		}
+		expected, err := parseGolden(string(buf))
+		if err != nil {
+			t.Fatalf("%s: %s", golden, err)
+		}
+		if diff := diffGolden(expected, actual); len(diff) > 0 {
+			t.Errorf("%s: exported metrics differ from %s, run go test -run Test_GoldenExposition -update if the changes are intended:\n%s",
+				version, golden, strings.Join(diff, "\n"))
+		}
+	}
+}
+
+func Test_GoldenDiff(t *testing.T) {
+	expected, err := parseGolden(`# HELP varnish_main_sessions Number of sessions
+# TYPE varnish_main_sessions counter
+varnish_main_sessions{type="conn"}
+varnish_main_sessions{type="drop"}
+# HELP varnish_main_uptime Child process uptime
+# TYPE varnish_main_uptime counter
+varnish_main_uptime{}
+# HELP varnish_backend_happy Happy health probes
+# TYPE varnish_backend_happy gauge
+varnish_backend_happy{backend="default",server="unknown"}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := parseGolden(`# HELP varnish_main_sess Number of sessions
+# TYPE varnish_main_sess counter
+varnish_main_sess{type="conn"}
+varnish_main_sess{type="drop"}
+# HELP varnish_main_uptime Child process uptime
+# TYPE varnish_main_uptime gauge
+varnish_main_uptime{}
+# HELP varnish_backend_happy Happy health probes
+# TYPE varnish_backend_happy gauge
+varnish_backend_happy{backend="default",server="unknown",vcl="boot"}
+# HELP varnish_main_esi_req ESI subrequests
+# TYPE varnish_main_esi_req counter
+varnish_main_esi_req{}
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := diffGolden(expected, actual)
+	t.Logf("\n%s", strings.Join(diff, "\n"))
+	expectedDiff := []string{
+		"renamed varnish_main_sessions -> varnish_main_sess",
+		"added varnish_main_esi_req (1 series)",
+		"type of varnish_main_uptime changed counter -> gauge",
+		`- varnish_backend_happy{backend="default",server="unknown"}`,
+		`+ varnish_backend_happy{backend="default",server="unknown",vcl="boot"}`,
+	}
+	if !matchStringSlices(diff, expectedDiff) {
+		t.Errorf("expected diff\n%s", strings.Join(expectedDiff, "\n"))
+	}
+	if diff := diffGolden(expected, expected); len(diff) != 0 {
+		t.Errorf("expected no differences, got %v", diff)
+	}
+	if _, err := parseGolden("varnish_main_uptime 1\n"); err == nil {
+		t.Error("expected error from invalid golden file")
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// Exec streams are multiplexed in binary websocket messages with the channel as the first byte
+	kubernetesExecProtocol = "v4.channel.k8s.io"
+	kubernetesStdout       = 1
+	kubernetesStderr       = 2
+	kubernetesStatus       = 3
+)
+
+type kubernetesParams struct {
+	LabelSelector string
+	Namespace     string
+	Container     string
+	PodLabels     string
+	APIServer     string
+	TokenFile     string
+	CAFile        string
+}
+
+func (p *kubernetesParams) enabled() bool {
+	return p.LabelSelector != ""
+}
+
+// kubernetesSource scrapes varnishstat in the pods matching a label selector
+// by running it through the Kubernetes exec API. Metrics of each pod are
+// labeled with the namespace and pod name, and optionally pod labels.
+type kubernetesSource struct {
+	sync.Mutex
+
+	params    *kubernetesParams
+	namespace string
+	apiServer *url.URL
+	client    *http.Client
+	tlsConfig *tls.Config
+	podLabels []string // pod label names, in labelKeys order after namespace and pod
+	labelKeys []string
+	targets   map[string]*kubernetesTarget // by namespace/pod
+}
+
+type kubernetesTarget struct {
+	*scrapeTarget
+	uid string
+}
+
+// https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.19/#pod-v1-core
+// Only the fields we use.
+type kubernetesPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string            `json:"name"`
+			Namespace string            `json:"namespace"`
+			UID       string            `json:"uid"`
+			Labels    map[string]string `json:"labels"`
+		} `json:"metadata"`
+		Spec struct {
+			Containers []struct {
+				Name string `json:"name"`
+			} `json:"containers"`
+		} `json:"spec"`
+		Status struct {
+			Phase string `json:"phase"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.19/#status-v1-meta
+type kubernetesStatusResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+}
+
+func newKubernetesSource(params *kubernetesParams) (*kubernetesSource, error) {
+	apiServer := params.APIServer
+	if apiServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("-k8s.api-server must be set when not running in a Kubernetes pod")
+		}
+		apiServer = "https://" + net.JoinHostPort(host, port)
+	}
+	apiServerURL, err := url.Parse(apiServer)
+	if err != nil {
+		return nil, fmt.Errorf("-k8s.api-server: %s", err)
+	}
+	if apiServerURL.Scheme != "http" && apiServerURL.Scheme != "https" {
+		return nil, fmt.Errorf("-k8s.api-server must be a http or https URL, given %q", apiServer)
+	}
+
+	namespace := params.Namespace
+	if namespace == "" {
+		// Default to the namespace we are running in
+		if b, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace")); err == nil {
+			namespace = strings.TrimSpace(string(b))
+		}
+		if namespace == "" {
+			namespace = "default"
+		}
+	}
+
+	tlsConfig := &tls.Config{}
+	if params.CAFile != "" && fileExists(params.CAFile) {
+		pem, err := ioutil.ReadFile(params.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("-k8s.ca-file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-k8s.ca-file: no certificates found in %s", params.CAFile)
+		}
+	}
+
+	s := &kubernetesSource{
+		params:    params,
+		namespace: namespace,
+		apiServer: apiServerURL,
+		tlsConfig: tlsConfig,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig, Proxy: http.ProxyFromEnvironment},
+		},
+		labelKeys: []string{"namespace", "pod"},
+		targets:   make(map[string]*kubernetesTarget),
+	}
+	for _, label := range strings.Split(params.PodLabels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			s.podLabels = append(s.podLabels, label)
+			s.labelKeys = append(s.labelKeys, "label_"+sanitizeLabelName(label))
+		}
+	}
+	return s, nil
+}
+
+func (s *kubernetesSource) LabelKeys() []string {
+	return s.labelKeys
+}
+
+// Targets lists the running pods matching the label selector.
+func (s *kubernetesSource) Targets(ctx context.Context) ([]*scrapeTarget, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	pods, err := s.listPods(ctx)
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]*kubernetesTarget)
+	targets := []*scrapeTarget{}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" || len(pod.Spec.Containers) == 0 {
+			continue
+		}
+		name := pod.Metadata.Namespace + "/" + pod.Metadata.Name
+		// A recreated pod with the same name, e.g. in a StatefulSet, can run another Varnish version
+		target := s.targets[name]
+		if target == nil || target.uid != pod.Metadata.UID {
+			namespace, podName := pod.Metadata.Namespace, pod.Metadata.Name
+			container := s.params.Container
+			if container == "" {
+				container = pod.Spec.Containers[0].Name
+			}
+			labelValues := []string{namespace, podName}
+			for _, label := range s.podLabels {
+				labelValues = append(labelValues, pod.Metadata.Labels[label])
+			}
+			exec := func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+				return s.exec(ctx, namespace, podName, container, append([]string{exe}, params...))
+			}
+			target = &kubernetesTarget{
+				scrapeTarget: newScrapeTarget(name, s.labelKeys, labelValues, exec),
+				uid:          pod.Metadata.UID,
+			}
+		}
+		current[name] = target
+		targets = append(targets, target.scrapeTarget)
+	}
+	s.targets = current
+	return targets, nil
+}
+
+func (s *kubernetesSource) listPods(ctx context.Context) (*kubernetesPodList, error) {
+	u := *s.apiServer
+	u.Path = fmt.Sprintf("/api/v1/namespaces/%s/pods", url.PathEscape(s.namespace))
+	u.RawQuery = url.Values{"labelSelector": {s.params.LabelSelector}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(req.Header); err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing pods failed: %s", kubernetesError(resp))
+	}
+	pods := &kubernetesPodList{}
+	if err := json.NewDecoder(resp.Body).Decode(pods); err != nil {
+		return nil, fmt.Errorf("listing pods failed: %s", err)
+	}
+	return pods, nil
+}
+
+// Runs command in the pod container. Returns stdout on success, stderr and stdout on failure.
+func (s *kubernetesSource) exec(ctx context.Context, namespace, pod, container string, command []string) (*bytes.Buffer, error) {
+	u := *s.apiServer
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path = fmt.Sprintf("/api/v1/namespaces/%s/pods/%s/exec", url.PathEscape(namespace), url.PathEscape(pod))
+	u.RawQuery = url.Values{
+		"command":   command,
+		"container": {container},
+		"stdout":    {"true"},
+		"stderr":    {"true"},
+	}.Encode()
+
+	config, err := websocket.NewConfig(u.String(), s.apiServer.String())
+	if err != nil {
+		return &bytes.Buffer{}, err
+	}
+	config.Protocol = []string{kubernetesExecProtocol}
+	config.TlsConfig = s.tlsConfig
+	if err := s.authorize(config.Header); err != nil {
+		return &bytes.Buffer{}, err
+	}
+	ws, err := config.DialContext(ctx)
+	if err != nil {
+		return &bytes.Buffer{}, fmt.Errorf("exec in pod %s/%s failed: %s", namespace, pod, err)
+	}
+	defer ws.Close()
+
+	// Unblock the reads below if the scrape is aborted
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	var execErr error
+	for {
+		var msg []byte
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			if ctx.Err() != nil {
+				execErr = ctx.Err()
+			} else if err != io.EOF && execErr == nil {
+				execErr = err
+			}
+			break
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		switch msg[0] {
+		case kubernetesStdout:
+			stdout.Write(msg[1:])
+		case kubernetesStderr:
+			stderr.Write(msg[1:])
+		case kubernetesStatus:
+			status := &kubernetesStatusResponse{}
+			if err := json.Unmarshal(msg[1:], status); err != nil {
+				execErr = fmt.Errorf("invalid exec status: %s", err)
+			} else if status.Status != "Success" {
+				execErr = fmt.Errorf("%s", status.Message)
+			}
+		}
+	}
+	if execErr != nil {
+		stderr.Write(stdout.Bytes())
+		return stderr, execErr
+	}
+	return stdout, nil
+}
+
+// Sets the service account token. The file is read on each request as projected tokens are rotated.
+func (s *kubernetesSource) authorize(header http.Header) error {
+	tokenFile := s.params.TokenFile
+	if tokenFile == "" || !fileExists(tokenFile) {
+		return nil
+	}
+	token, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return fmt.Errorf("-k8s.token-file: %s", err)
+	}
+	header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return nil
+}
+
+func kubernetesError(resp *http.Response) string {
+	status := &kubernetesStatusResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(status); err == nil && status.Message != "" {
+		return fmt.Sprintf("%s: %s", resp.Status, status.Message)
+	}
+	return resp.Status
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/websocket"
+)
+
+// Fake API server with two running varnish pods, one of them broken, and a pending pod.
+func newFakeKubernetesAPI(t *testing.T, token string) *httptest.Server {
+	dir, _ := os.Getwd()
+	stats, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape/6.5.1.json"))
+	if err != nil {
+		t.Skipf("Cannot read test file: %s", err)
+	}
+	pods := `{"items": [
+		{"metadata": {"name": "varnish-0", "namespace": "web", "uid": "a", "labels": {"app": "varnish", "app.kubernetes.io/version": "6.5"}},
+		 "spec": {"containers": [{"name": "varnish"}, {"name": "sidecar"}]}, "status": {"phase": "Running"}},
+		{"metadata": {"name": "varnish-1", "namespace": "web", "uid": "b", "labels": {"app": "varnish"}},
+		 "spec": {"containers": [{"name": "varnish"}]}, "status": {"phase": "Running"}},
+		{"metadata": {"name": "varnish-2", "namespace": "web", "uid": "c", "labels": {"app": "varnish"}},
+		 "spec": {"containers": [{"name": "varnish"}]}, "status": {"phase": "Pending"}}
+	]}`
+
+	exec := websocket.Server{
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			config.Protocol = []string{kubernetesExecProtocol}
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			r := ws.Request()
+			query := r.URL.Query()
+			send := func(channel byte, data []byte) {
+				websocket.Message.Send(ws, append([]byte{channel}, data...))
+			}
+			status := func(status kubernetesStatusResponse) {
+				b, _ := json.Marshal(status)
+				send(kubernetesStatus, b)
+			}
+			if query.Get("container") != "varnish" {
+				t.Errorf("exec in container %q", query.Get("container"))
+			}
+			if strings.Contains(r.URL.Path, "/pods/varnish-1/") {
+				send(kubernetesStderr, []byte("Could not get hold of varnishd, is it running?\n"))
+				status(kubernetesStatusResponse{Status: "Failure", Message: "command terminated with non-zero exit code", Reason: "NonZeroExitCode"})
+				return
+			}
+			switch command := strings.Join(query["command"], " "); {
+			case command == "varnishstat -V":
+				send(kubernetesStdout, []byte("varnishstat (varnish-6.5.1 revision 1dae23376bb5ea7a6b8e9e4b9ed95cdc9469fb64)\n"))
+			case strings.HasPrefix(command, "varnishstat -j"):
+				send(kubernetesStdout, stats)
+			default:
+				t.Errorf("unexpected command %q", command)
+			}
+			status(kubernetesStatusResponse{Status: "Success"})
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/web/pods", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("labelSelector") != "app=varnish" {
+			t.Errorf("unexpected label selector %q", r.URL.Query().Get("labelSelector"))
+		}
+		w.Write([]byte(pods))
+	})
+	mux.Handle("/api/v1/namespaces/web/pods/", exec)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status": "Failure", "message": "Unauthorized"}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+func Test_KubernetesSource(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeKubernetesAPI(t, "secret")
+	defer server.Close()
+
+	source, err := newKubernetesSource(&kubernetesParams{
+		LabelSelector: "app=varnish",
+		Namespace:     "web",
+		Container:     "varnish",
+		PodLabels:     "app.kubernetes.io/version",
+		APIServer:     server.URL,
+		TokenFile:     tokenFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewPrometheusExporter()
+	if err := exporter.Initialize(source); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily)
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	labels := func(m *dto.Metric) map[string]string {
+		labels := make(map[string]string)
+		for _, label := range m.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		return labels
+	}
+
+	up := map[string]float64{}
+	for _, m := range byName["varnish_up"].GetMetric() {
+		up[labels(m)["pod"]] = m.GetGauge().GetValue()
+	}
+	t.Logf("varnish_up %v", up)
+	if len(up) != 2 || up["varnish-0"] != 1 || up["varnish-1"] != 0 {
+		t.Errorf("unexpected varnish_up %v", up)
+	}
+
+	happy := byName["varnish_backend_happy"]
+	if happy == nil || len(happy.GetMetric()) == 0 {
+		t.Fatal("varnish_backend_happy not exported")
+	}
+	for _, m := range happy.GetMetric() {
+		l := labels(m)
+		if l["namespace"] != "web" || l["pod"] != "varnish-0" || l["label_app_kubernetes_io_version"] != "6.5" {
+			t.Errorf("unexpected labels %v", l)
+		}
+	}
+	for _, m := range byName["varnish_version"].GetMetric() {
+		if l := labels(m); l["pod"] != "varnish-0" || l["version"] != "6.5.1" {
+			t.Errorf("unexpected version labels %v", l)
+		}
+	}
+
+	// Wrong token
+	if err := ioutil.WriteFile(tokenFile, []byte("wrong"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.Targets(exporter.ctx); err == nil || !strings.Contains(err.Error(), "Unauthorized") {
+		t.Errorf("expected unauthorized error, got %v", err)
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Resolutions of metrics with different label names than other metrics of the same name,
+// the -labels.conflict values.
+const (
+	labelConflictPad    = "pad"    // add the missing labels with empty values
+	labelConflictDrop   = "drop"   // keep only the metrics with the most common label names
+	labelConflictRename = "rename" // export the less common label names as <name>_by_<labels>
+)
+
+var labelConflictPolicies = []string{labelConflictPad, labelConflictDrop, labelConflictRename}
+
+// Reasons of varnish_exporter_label_conflicts_total
+const (
+	labelConflictNames           = "label_names"      // label names differ from other metrics of the name
+	labelConflictDuplicateLabel  = "duplicate_label"  // the same label twice, e.g. a backend and a target label
+	labelConflictDuplicateSeries = "duplicate_series" // the same name and label values twice
+)
+
+var labelConflictReasons = []string{labelConflictNames, labelConflictDuplicateLabel, labelConflictDuplicateSeries}
+
+type guardedMetric struct {
+	counter     string // the varnishstat counter, for logging
+	name        string
+	help        string
+	valueType   prometheus.ValueType
+	value       float64
+	labelKeys   []string
+	labelValues []string
+}
+
+// labelConflictHistory is kept by the exporter from one scrape to the next, it holds
+// the names and conflicts of the last scrape only.
+type labelConflictHistory struct {
+	sync.Mutex
+	names  map[string]bool // with different label names, buffered by the next scrape
+	logged map[string]bool // reason and name of the conflicts logged as warnings
+}
+
+func newLabelConflictHistory() *labelConflictHistory {
+	return &labelConflictHistory{
+		names:  make(map[string]bool),
+		logged: make(map[string]bool),
+	}
+}
+
+// Keeps the conflicts of the flushed guard. A scrape of a single target adds to the
+// conflicts of the other targets instead of replacing them.
+func (h *labelConflictHistory) update(g *labelGuard, complete bool) {
+	g.Lock()
+	names, logged := g.conflicting, g.logged
+	g.Unlock()
+
+	h.Lock()
+	defer h.Unlock()
+	if !complete {
+		names, logged = mergeSets(h.names, names), mergeSets(h.logged, logged)
+	}
+	h.names, h.logged = names, logged
+}
+
+// labelGuard resolves the label conflicts of the metrics of a scrape as they are added.
+// Metrics of the same name with different label names, or the same label values, fail the
+// whole gather in the registry. The metrics of a name get the label names of the first one
+// sent, names that had different label names in the previous scrape are buffered until
+// Flush instead, to resolve them together regardless of the order they are added in.
+type labelGuard struct {
+	sync.Mutex
+	policy string
+	emit   func(ctx context.Context, m *guardedMetric)
+
+	buffering map[string]bool // names of the history, shared with it
+	warned    map[string]bool // conflicts of the history, shared with it
+	buffered  []*guardedMetric
+
+	labelKeys   map[string][]string // of the metrics sent, by name
+	series      map[uint64]bool     // of the metrics sent
+	conflicting map[string]bool     // names with different label names
+	logged      map[string]bool     // reason and name of the conflicts
+	conflicts   map[string]int      // by reason
+}
+
+// Returns a guard sending the resolved metrics to emit. Without history the metrics
+// of every name are sent as they are added.
+func newLabelGuard(policy string, history *labelConflictHistory, emit func(ctx context.Context, m *guardedMetric)) *labelGuard {
+	g := &labelGuard{
+		policy:      policy,
+		emit:        emit,
+		labelKeys:   make(map[string][]string),
+		series:      make(map[uint64]bool),
+		conflicting: make(map[string]bool),
+		logged:      make(map[string]bool),
+		conflicts:   make(map[string]int),
+	}
+	if history != nil {
+		// The maps are replaced by update, not modified
+		history.Lock()
+		g.buffering, g.warned = history.names, history.logged
+		history.Unlock()
+	}
+	return g
+}
+
+// Returns the emit function of a guard sending the metrics to ch.
+func sendMetrics(ch chan<- prometheus.Metric) func(ctx context.Context, m *guardedMetric) {
+	return func(ctx context.Context, m *guardedMetric) {
+		descKey := m.name + "_" + strings.Join(m.labelKeys, "_")
+		desc := DescCache.Desc(descKey)
+		if desc == nil {
+			desc = DescCache.Set(descKey, prometheus.NewDesc(m.name, m.help, m.labelKeys, nil))
+		}
+		metric, err := prometheus.NewConstMetric(desc, m.valueType, m.value, m.labelValues...)
+		if err != nil {
+			logParse.DebugContext(ctx, "Failed to export counter", "counter", m.counter, "err", err)
+			return
+		}
+		ch <- metric
+	}
+}
+
+type labelGuardKey struct{}
+
+// Returns ctx with guard, ScrapeVarnishFrom adds its metrics to the guard of ctx instead of
+// its own, for guarding the metrics of all targets of a scrape.
+func withLabelGuard(ctx context.Context, guard *labelGuard) context.Context {
+	return context.WithValue(ctx, labelGuardKey{}, guard)
+}
+
+func labelGuardFrom(ctx context.Context) *labelGuard {
+	guard, _ := ctx.Value(labelGuardKey{}).(*labelGuard)
+	return guard
+}
+
+// Sends m, or buffers it until Flush if its name had conflicts in the previous scrape.
+// Duplicate label names are resolved here, the earlier occurrences are renamed
+// exported_<label> as by Prometheus honor_labels.
+func (g *labelGuard) Add(ctx context.Context, m *guardedMetric) {
+	for i := 0; i < len(m.labelKeys); i++ {
+		if indexOf(m.labelKeys[i+1:], m.labelKeys[i]) == -1 {
+			continue
+		}
+		g.conflict(ctx, labelConflictDuplicateLabel, g.policy, m.name, m.labelKeys, []string{m.counter})
+		if g.policy == labelConflictDrop {
+			return
+		}
+		keys := append([]string{}, m.labelKeys...)
+		keys[i] = "exported_" + keys[i]
+		m.labelKeys = keys
+		// Check the renamed label again
+		i--
+	}
+
+	if g.buffering[m.name] {
+		g.Lock()
+		g.buffered = append(g.buffered, m)
+		g.Unlock()
+		return
+	}
+	g.stream(ctx, m, g.policy)
+}
+
+// Sends m with the label names of the metrics of its name sent before. With other label
+// names m is resolved as per policy, but the pad policy can't add labels to the metrics
+// already sent and drops m unless its labels are a subset.
+func (g *labelGuard) stream(ctx context.Context, m *guardedMetric, policy string) {
+	g.Lock()
+	keys, ok := g.labelKeys[m.name]
+	if !ok {
+		keys = m.labelKeys
+		g.labelKeys[m.name] = keys
+	}
+	g.Unlock()
+
+	if !sameLabelKeys(keys, m.labelKeys) {
+		if labelSignature(keys) != labelSignature(m.labelKeys) {
+			g.conflict(ctx, labelConflictNames, policy, m.name, m.labelKeys, []string{m.counter})
+			switch {
+			case policy == labelConflictRename:
+				g.stream(ctx, renamedMetric(m), labelConflictDrop)
+				return
+			case policy == labelConflictPad && containsAll(keys, m.labelKeys):
+			default:
+				return
+			}
+		}
+		m = padLabels(m, keys)
+	}
+
+	key := seriesKey(m)
+	g.Lock()
+	duplicate := g.series[key]
+	g.series[key] = true
+	g.Unlock()
+	if duplicate {
+		g.conflict(ctx, labelConflictDuplicateSeries, labelConflictDrop, m.name, m.labelKeys, []string{m.counter})
+		return
+	}
+	g.emit(ctx, m)
+}
+
+// Resolves the label conflicts of the buffered metrics and sends them.
+func (g *labelGuard) Flush(ctx context.Context) {
+	g.Lock()
+	metrics := g.buffered
+	g.buffered = nil
+	g.Unlock()
+
+	resolved := g.resolve(ctx, metrics, g.policy)
+	if g.policy == labelConflictRename {
+		// A renamed metric may clash with the label names of an existing <name>_by_<labels>
+		resolved = g.resolve(ctx, resolved, labelConflictDrop)
+	}
+	for _, m := range resolved {
+		g.stream(ctx, m, labelConflictDrop)
+	}
+}
+
+// Returns the metrics with the same label names for each name as per policy.
+func (g *labelGuard) resolve(ctx context.Context, metrics []*guardedMetric, policy string) []*guardedMetric {
+	// Sorted for the same resolution regardless of the order the targets were scraped in
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+	var resolved []*guardedMetric
+	for start := 0; start < len(metrics); {
+		end := start + 1
+		for end < len(metrics) && metrics[end].name == metrics[start].name {
+			end++
+		}
+		resolved = append(resolved, g.resolveLabelNames(ctx, metrics[start].name, metrics[start:end], policy)...)
+		start = end
+	}
+	return resolved
+}
+
+func (g *labelGuard) resolveLabelNames(ctx context.Context, name string, metrics []*guardedMetric, policy string) []*guardedMetric {
+	consistent := true
+	for _, m := range metrics[1:] {
+		if !sameLabelKeys(m.labelKeys, metrics[0].labelKeys) {
+			consistent = false
+			break
+		}
+	}
+	if consistent {
+		return metrics
+	}
+
+	bySignature := make(map[string][]*guardedMetric)
+	var signatures []string
+	for _, m := range metrics {
+		signature := labelSignature(m.labelKeys)
+		if bySignature[signature] == nil {
+			signatures = append(signatures, signature)
+		}
+		bySignature[signature] = append(bySignature[signature], m)
+	}
+	if len(signatures) == 1 {
+		// Same labels in different order
+		resolved := make([]*guardedMetric, len(metrics))
+		for i, m := range metrics {
+			resolved[i] = padLabels(m, metrics[0].labelKeys)
+		}
+		return resolved
+	}
+
+	// The most common label names first, then by names
+	sort.Slice(signatures, func(i, j int) bool {
+		a, b := bySignature[signatures[i]], bySignature[signatures[j]]
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return signatures[i] < signatures[j]
+	})
+
+	var padKeys []string
+	if policy == labelConflictPad {
+		for _, signature := range signatures {
+			for _, key := range bySignature[signature][0].labelKeys {
+				if indexOf(padKeys, key) == -1 {
+					padKeys = append(padKeys, key)
+				}
+			}
+		}
+	}
+
+	var resolved []*guardedMetric
+	for i, signature := range signatures {
+		group := bySignature[signature]
+		if i > 0 {
+			var counters []string
+			for _, m := range group {
+				counters = append(counters, m.counter)
+			}
+			g.conflict(ctx, labelConflictNames, policy, name, group[0].labelKeys, counters)
+		}
+		switch {
+		case policy == labelConflictPad:
+			for _, m := range group {
+				resolved = append(resolved, padLabels(m, padKeys))
+			}
+		case i == 0:
+			resolved = append(resolved, group...)
+		case policy == labelConflictRename:
+			for _, m := range group {
+				resolved = append(resolved, renamedMetric(m))
+			}
+		}
+	}
+	return resolved
+}
+
+// Counts the conflict, logged as a warning unless it was in the previous scrape.
+func (g *labelGuard) conflict(ctx context.Context, reason, policy, name string, labelKeys, counters []string) {
+	key := reason + " " + name
+	g.Lock()
+	g.conflicts[reason] += len(counters)
+	if reason == labelConflictNames {
+		g.conflicting[name] = true
+	}
+	logged := g.logged[key] || g.warned[key]
+	g.logged[key] = true
+	g.Unlock()
+
+	args := []interface{}{"reason", reason, "metric", name, "labels", strings.Join(labelKeys, ","), "counters", strings.Join(counters, ","), "policy", policy}
+	if logged {
+		logScrape.DebugContext(ctx, "Label conflict", args...)
+	} else {
+		logScrape.WarnContext(ctx, "Label conflict", args...)
+	}
+}
+
+// Returns the number of conflicts by reason.
+func (g *labelGuard) Conflicts() map[string]int {
+	g.Lock()
+	defer g.Unlock()
+	conflicts := make(map[string]int, len(g.conflicts))
+	for reason, count := range g.conflicts {
+		conflicts[reason] = count
+	}
+	return conflicts
+}
+
+// Returns a copy of m with the labels keys, missing labels have empty values.
+func padLabels(m *guardedMetric, keys []string) *guardedMetric {
+	padded := *m
+	padded.labelKeys = keys
+	padded.labelValues = make([]string, len(keys))
+	for i, key := range keys {
+		if j := indexOf(m.labelKeys, key); j != -1 {
+			padded.labelValues[i] = m.labelValues[j]
+		}
+	}
+	return &padded
+}
+
+func sameLabelKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func labelSignature(labelKeys []string) string {
+	return strings.Join(sortedCopy(labelKeys), ",")
+}
+
+// Returns the hash of the series of m, once resolved the metrics of a name have the labels in the same order.
+func seriesKey(m *guardedMetric) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.name))
+	for _, value := range m.labelValues {
+		h.Write([]byte{0xff})
+		h.Write([]byte(value))
+	}
+	return h.Sum64()
+}
+
+// Returns a copy of m named <name>_by_<labels>, for the rename policy.
+func renamedMetric(m *guardedMetric) *guardedMetric {
+	renamed := *m
+	renamed.name = m.name + "_by_" + strings.Join(sortedCopy(m.labelKeys), "_")
+	if len(m.labelKeys) == 0 {
+		renamed.name = m.name + "_unlabeled"
+	}
+	return &renamed
+}
+
+// Returns whether keys has all the keys of subset.
+func containsAll(keys, subset []string) bool {
+	for _, key := range subset {
+		if indexOf(keys, key) == -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns a new set with the keys of a and b.
+func mergeSets(a, b map[string]bool) map[string]bool {
+	merged := make(map[string]bool, len(a)+len(b))
+	for key := range a {
+		merged[key] = true
+	}
+	for key := range b {
+		merged[key] = true
+	}
+	return merged
+}
+
+func sortedCopy(s []string) []string {
+	sorted := append([]string{}, s...)
+	sort.Strings(sorted)
+	return sorted
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func testGuardedMetric(counter, name string, labels ...string) *guardedMetric {
+	m := &guardedMetric{counter: counter, name: name, help: name, valueType: prometheus.GaugeValue}
+	for i := 0; i+1 < len(labels); i += 2 {
+		m.labelKeys, m.labelValues = append(m.labelKeys, labels[i]), append(m.labelValues, labels[i+1])
+	}
+	return m
+}
+
+// Returns a guard and a function returning its series as name{label="value",...}, sorted,
+// once flushed.
+func newTestGuard(policy string, history *labelConflictHistory) (*labelGuard, func() []string) {
+	var series []string
+	guard := newLabelGuard(policy, history, func(ctx context.Context, m *guardedMetric) {
+		labels := make([]string, len(m.labelKeys))
+		for i, key := range m.labelKeys {
+			labels[i] = key + "=\"" + m.labelValues[i] + "\""
+		}
+		sort.Strings(labels)
+		series = append(series, m.name+"{"+strings.Join(labels, ",")+"}")
+	})
+	return guard, func() []string {
+		sort.Strings(series)
+		return series
+	}
+}
+
+func Test_LabelGuard(t *testing.T) {
+	metrics := func() []*guardedMetric {
+		return []*guardedMetric{
+			testGuardedMetric("MAIN.a", "varnish_main_a"),
+			testGuardedMetric("MAIN.x.a", "varnish_main_a", "id", "x"),
+			testGuardedMetric("MAIN.y.a", "varnish_main_a", "id", "y"),
+			testGuardedMetric("MAIN.b", "varnish_main_b", "type", "s0"),
+			testGuardedMetric("MAIN.b", "varnish_main_b", "type", "s0"),
+			testGuardedMetric("VBE.boot.default.happy", "varnish_backend_happy", "backend", "default", "host", "example.com", "host", "varnish1"),
+		}
+	}
+	for _, test := range []struct {
+		policy    string
+		series    []string
+		conflicts map[string]int
+	}{
+		{labelConflictPad, []string{
+			`varnish_backend_happy{backend="default",exported_host="example.com",host="varnish1"}`,
+			`varnish_main_a{id=""}`,
+			`varnish_main_a{id="x"}`,
+			`varnish_main_a{id="y"}`,
+			`varnish_main_b{type="s0"}`,
+		}, map[string]int{labelConflictNames: 1, labelConflictDuplicateLabel: 1, labelConflictDuplicateSeries: 1}},
+		{labelConflictDrop, []string{
+			`varnish_main_a{id="x"}`,
+			`varnish_main_a{id="y"}`,
+			`varnish_main_b{type="s0"}`,
+		}, map[string]int{labelConflictNames: 1, labelConflictDuplicateLabel: 1, labelConflictDuplicateSeries: 1}},
+		{labelConflictRename, []string{
+			`varnish_backend_happy{backend="default",exported_host="example.com",host="varnish1"}`,
+			`varnish_main_a_unlabeled{}`,
+			`varnish_main_a{id="x"}`,
+			`varnish_main_a{id="y"}`,
+			`varnish_main_b{type="s0"}`,
+		}, map[string]int{labelConflictNames: 1, labelConflictDuplicateLabel: 1, labelConflictDuplicateSeries: 1}},
+	} {
+		// The same regardless of the order the metrics are added in once the conflicts are known
+		for _, reverse := range []bool{false, true} {
+			history := newLabelConflictHistory()
+			for scrape := 1; scrape <= 2; scrape++ {
+				guard, flushed := newTestGuard(test.policy, history)
+				added := metrics()
+				if reverse {
+					for i, j := 0, len(added)-1; i < j; i, j = i+1, j-1 {
+						added[i], added[j] = added[j], added[i]
+					}
+				}
+				for _, m := range added {
+					guard.Add(context.Background(), m)
+				}
+				guard.Flush(context.Background())
+				history.update(guard, true)
+				series := flushed()
+				t.Logf("%s scrape %d: %v", test.policy, scrape, series)
+				if scrape == 1 {
+					// Streamed before the conflict is known, but with consistent label names
+					if labels := labelNamesByName(series); labels["varnish_main_a"] > 1 {
+						t.Errorf("%s: different label names of varnish_main_a in %v", test.policy, series)
+					}
+					continue
+				}
+				if !matchStringSlices(series, test.series) {
+					t.Errorf("%s: expected\n%s\ngot\n%s", test.policy, strings.Join(test.series, "\n"), strings.Join(series, "\n"))
+				}
+				conflicts := guard.Conflicts()
+				for _, reason := range labelConflictReasons {
+					if conflicts[reason] != test.conflicts[reason] {
+						t.Errorf("%s: expected %d %s conflicts, got %d", test.policy, test.conflicts[reason], reason, conflicts[reason])
+					}
+				}
+			}
+		}
+	}
+
+	// A renamed metric clashing with an existing name is resolved again, the tie by the label names
+	history := newLabelConflictHistory()
+	var series []string
+	for scrape := 1; scrape <= 2; scrape++ {
+		guard, flushed := newTestGuard(labelConflictRename, history)
+		for _, m := range []*guardedMetric{
+			testGuardedMetric("A.x", "a", "id", "x"),
+			testGuardedMetric("A.y", "a", "id", "y"),
+			testGuardedMetric("A.z", "a", "type", "z"),
+			testGuardedMetric("A_BY_TYPE", "a_by_type"),
+		} {
+			guard.Add(context.Background(), m)
+		}
+		guard.Flush(context.Background())
+		history.update(guard, true)
+		series = flushed()
+		t.Logf("rename clash scrape %d: %v", scrape, series)
+	}
+	if expected := []string{`a_by_type{}`, `a{id="x"}`, `a{id="y"}`}; !matchStringSlices(series, expected) {
+		t.Errorf("expected %v, got %v", expected, series)
+	}
+}
+
+// Returns the number of different label names of each name in series.
+func labelNamesByName(series []string) map[string]int {
+	names := make(map[string]map[string]bool)
+	for _, s := range series {
+		name, labels := s[:strings.Index(s, "{")], strings.Split(strings.Trim(s[strings.Index(s, "{"):], "{}"), ",")
+		for i, label := range labels {
+			labels[i] = strings.SplitN(label, "=", 2)[0]
+		}
+		if names[name] == nil {
+			names[name] = make(map[string]bool)
+		}
+		names[name][strings.Join(labels, ",")] = true
+	}
+	counts := make(map[string]int, len(names))
+	for name, labels := range names {
+		counts[name] = len(labels)
+	}
+	return counts
+}
+
+// Only the conflicts of the last scrape are kept, and logged as warnings once.
+func Test_LabelConflictHistory(t *testing.T) {
+	logs := &bytes.Buffer{}
+	if err := LogConfig.Initialize(logs, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { LogConfig.Initialize(os.Stdout, false) })
+
+	history := newLabelConflictHistory()
+	scrape := func(complete bool, metrics ...*guardedMetric) {
+		guard, _ := newTestGuard(labelConflictPad, history)
+		for _, m := range metrics {
+			guard.Add(context.Background(), m)
+		}
+		guard.Flush(context.Background())
+		history.update(guard, complete)
+	}
+	conflicting := []*guardedMetric{
+		testGuardedMetric("MAIN.x.a", "varnish_main_a", "id", "x"),
+		testGuardedMetric("MAIN.a", "varnish_main_a"),
+	}
+	for i := 0; i < 3; i++ {
+		scrape(true, conflicting...)
+	}
+	if warnings := strings.Count(logs.String(), "level=WARN"); warnings != 1 {
+		t.Errorf("expected 1 warning, got %d:\n%s", warnings, logs)
+	}
+	if !history.names["varnish_main_a"] || len(history.logged) != 1 {
+		t.Errorf("expected the varnish_main_a conflict, got %v %v", history.names, history.logged)
+	}
+
+	// A scrape of a single target keeps the conflicts of the others
+	scrape(false, testGuardedMetric("MAIN.b", "varnish_main_b"))
+	if !history.names["varnish_main_a"] {
+		t.Errorf("expected the varnish_main_a conflict to be kept, got %v", history.names)
+	}
+	scrape(true, testGuardedMetric("MAIN.b", "varnish_main_b"))
+	if len(history.names) != 0 || len(history.logged) != 0 {
+		t.Errorf("expected no conflicts, got %v %v", history.names, history.logged)
+	}
+}
+
+type testSource struct {
+	labelKeys []string
+	targets   []*scrapeTarget
+}
+
+func (s *testSource) LabelKeys() []string {
+	return s.labelKeys
+}
+
+func (s *testSource) Targets(ctx context.Context) ([]*scrapeTarget, error) {
+	return s.targets, nil
+}
+
+// A target label that is also a backend label is exported as exported_<label>
+// instead of failing the gather.
+func Test_LabelConflictsExport(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixture := filepath.Join(dir, "test/scrape/6.5.1.json")
+	if !fileExists(fixture) {
+		t.Skipf("Cannot find test file %s", fixture)
+	}
+	buf, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := BackendNames
+	BackendNames = mustBackendNameParser(nil, []string{"host"})
+	t.Cleanup(func() { BackendNames = previous })
+
+	target := newScrapeTarget("varnish1", []string{"host"}, []string{"varnish1"}, func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+		if len(params) == 1 && params[0] == "-V" {
+			return bytes.NewBufferString("varnishstat (varnish-6.5.1 revision 1dae23376bb5ea7a6b8e9e4b9ed95cdc9469fb64)"), nil
+		}
+		return bytes.NewBuffer(buf), nil
+	})
+	pe := NewPrometheusExporter()
+	if err := pe.Initialize(&testSource{labelKeys: []string{"host"}, targets: []*scrapeTarget{target}}); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(pe)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		switch family.GetName() {
+		case "varnish_backend_happy":
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range m.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				t.Logf("%s %v", family.GetName(), labels)
+				if labels["host"] != "varnish1" {
+					t.Errorf("expected target label host=varnish1, got %v", labels)
+				}
+				if _, ok := labels["exported_host"]; !ok {
+					t.Errorf("expected exported_host backend label, got %v", labels)
+				}
+				found = true
+			}
+		case "varnish_exporter_label_conflicts_total":
+			for _, m := range family.GetMetric() {
+				if reason := m.GetLabel()[0].GetValue(); reason == labelConflictDuplicateLabel && m.GetCounter().GetValue() == 0 {
+					t.Errorf("expected %s conflicts", reason)
+				}
+			}
+		}
+	}
+	if !found {
+		t.Error("missing varnish_backend_happy")
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+var (
+	LogConfig = &logConfig{
+		Level:  "info",
+		Format: logFormatLogfmt,
+	}
+
+	// Subsystem loggers. Each can be set to debug level with -log.debug
+	// without enabling debug logging for everything else.
+	logMain      = newSubsystemLogger("main")
+	logScrape    = newSubsystemLogger("scrape")
+	logParse     = newSubsystemLogger("parse")
+	logCollector = newSubsystemLogger("collector")
+	logRestart   = newSubsystemLogger("restart")
+	logPanic     = newSubsystemLogger("panic")
+	logTextfile  = newSubsystemLogger("textfile")
+	logHTTP      = newSubsystemLogger("http")
+)
+
+type logConfig struct {
+	sync.RWMutex
+
+	Level  string
+	Format string
+	Debug  string // comma separated subsystems
+
+	level   slog.Level
+	debug   map[string]bool
+	handler slog.Handler
+}
+
+// Initialize parses the configuration and sets up the output handler.
+func (lc *logConfig) Initialize(w io.Writer, raw bool) error {
+	lc.Lock()
+	defer lc.Unlock()
+
+	if err := lc.level.UnmarshalText([]byte(lc.Level)); err != nil {
+		return fmt.Errorf("-log.level: %s", err)
+	}
+	lc.debug = make(map[string]bool)
+	for _, subsystem := range strings.Split(lc.Debug, ",") {
+		if subsystem = strings.TrimSpace(subsystem); subsystem == "" {
+			continue
+		}
+		if !isLogSubsystem(subsystem) {
+			return fmt.Errorf("-log.debug: unknown subsystem %q, available subsystems: %s", subsystem, strings.Join(logSubsystems(), ", "))
+		}
+		lc.debug[subsystem] = true
+	}
+
+	// Level filtering is done per subsystem in Enabled
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	if raw {
+		opts.ReplaceAttr = func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		}
+	}
+	switch lc.Format {
+	case logFormatLogfmt:
+		lc.handler = slog.NewTextHandler(w, opts)
+	case logFormatJSON:
+		lc.handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("-log.format must be %q or %q, given %q", logFormatLogfmt, logFormatJSON, lc.Format)
+	}
+	return nil
+}
+
+func (lc *logConfig) enabled(subsystem string, level slog.Level) bool {
+	lc.RLock()
+	defer lc.RUnlock()
+	return level >= lc.level || (level >= slog.LevelDebug && lc.debug[subsystem])
+}
+
+func (lc *logConfig) output() slog.Handler {
+	lc.RLock()
+	defer lc.RUnlock()
+	if lc.handler == nil {
+		// Not yet initialized, e.g. when running tests
+		return slog.NewTextHandler(os.Stdout, nil)
+	}
+	return lc.handler
+}
+
+var (
+	logSubsystemsMu sync.Mutex
+	logSubsystemSet = make(map[string]bool)
+)
+
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	logSubsystemsMu.Lock()
+	logSubsystemSet[subsystem] = true
+	logSubsystemsMu.Unlock()
+	return slog.New(&subsystemHandler{subsystem: subsystem})
+}
+
+func isLogSubsystem(subsystem string) bool {
+	logSubsystemsMu.Lock()
+	defer logSubsystemsMu.Unlock()
+	return logSubsystemSet[subsystem]
+}
+
+func logSubsystems() (subsystems []string) {
+	logSubsystemsMu.Lock()
+	defer logSubsystemsMu.Unlock()
+	for subsystem := range logSubsystemSet {
+		subsystems = append(subsystems, subsystem)
+	}
+	sort.Strings(subsystems)
+	return subsystems
+}
+
+// subsystemHandler applies the per subsystem level and writes to the
+// configured output handler. Handlers are resolved on each log call so
+// the subsystem loggers can be package level variables created before
+// the command line flags are parsed.
+type subsystemHandler struct {
+	subsystem string
+	ops       []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return LogConfig.enabled(h.subsystem, level)
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	handler := LogConfig.output().WithAttrs([]slog.Attr{slog.String("subsystem", h.subsystem)})
+	for _, op := range h.ops {
+		handler = op(handler)
+	}
+	if attrs := logAttrsFrom(ctx); len(attrs) > 0 {
+		r.AddAttrs(attrs...)
+	}
+	return handler.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *subsystemHandler) with(op func(slog.Handler) slog.Handler) *subsystemHandler {
+	ops := make([]func(slog.Handler) slog.Handler, len(h.ops), len(h.ops)+1)
+	copy(ops, h.ops)
+	return &subsystemHandler{subsystem: h.subsystem, ops: append(ops, op)}
+}
+
+// context fields
+
+type logAttrsKey struct{}
+
+// Returns a context that adds the given key value pairs to all log
+// lines written with it, e.g. the scrape id and varnish instance.
+func withLogAttrs(ctx context.Context, args ...interface{}) context.Context {
+	attrs := append([]slog.Attr{}, logAttrsFrom(ctx)...)
+	record := slog.Record{}
+	record.Add(args...)
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a)
+		return true
+	})
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+func logAttrsFrom(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return attrs
+}
+
+// helpers
+
+// Returns a standard library logger for APIs that need one, e.g. promhttp.
+func stdLogger(l *slog.Logger, level slog.Level) *log.Logger {
+	return slog.NewLogLogger(l.Handler(), level)
+}
+
+// Writes to stdout as is, used for -test output.
+func logRaw(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+func logFatal(l *slog.Logger, msg string, args ...interface{}) {
+	l.Error(msg, args...)
+	os.Exit(1)
+}
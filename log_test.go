@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_SubsystemLogging(t *testing.T) {
+	defer func() {
+		LogConfig.Level, LogConfig.Format, LogConfig.Debug = "info", logFormatLogfmt, ""
+		LogConfig.Initialize(os.Stdout, false)
+	}()
+
+	buf := &bytes.Buffer{}
+	LogConfig.Level, LogConfig.Format, LogConfig.Debug = "warn", logFormatJSON, "parse"
+	if err := LogConfig.Initialize(buf, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := withLogAttrs(context.Background(), "scrape_id", 7, "instance", "test")
+	logScrape.InfoContext(ctx, "filtered by -log.level")
+	logScrape.WarnContext(ctx, "scrape warning")
+	logParse.DebugContext(ctx, "parse debug", "counter", "MAIN.uptime")
+	logRestart.Debug("filtered, not in -log.debug")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d:\n%s", len(lines), buf)
+	}
+	for i, expected := range []map[string]interface{}{
+		{"level": "WARN", "msg": "scrape warning", "subsystem": "scrape", "scrape_id": 7.0, "instance": "test"},
+		{"level": "DEBUG", "msg": "parse debug", "subsystem": "parse", "scrape_id": 7.0, "counter": "MAIN.uptime"},
+	} {
+		fields := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(lines[i]), &fields); err != nil {
+			t.Fatalf("%s: %s", err, lines[i])
+		}
+		if _, ok := fields["time"]; ok {
+			t.Errorf("raw logging should not include time: %s", lines[i])
+		}
+		for key, value := range expected {
+			if fields[key] != value {
+				t.Errorf("%s: %s %#v != %#v", lines[i], key, fields[key], value)
+			}
+		}
+	}
+
+	LogConfig.Debug = "nope"
+	if err := LogConfig.Initialize(buf, false); err == nil {
+		t.Error("expected error from unknown subsystem")
+	}
+	LogConfig.Debug, LogConfig.Format = "", "xml"
+	if err := LogConfig.Initialize(buf, false); err == nil {
+		t.Error("expected error from unknown format")
+	}
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,23 +31,56 @@ var (
 	PrometheusExporter = NewPrometheusExporter()
 	VarnishVersion     = NewVarnishVersion()
 	ExitHandler        = &exitHandler{}
+	scrapeCounter      uint64
 
 	StartParams = &startParams{
-		ListenAddress:  ":9131", // Reserved and publicly announced at https://github.com/prometheus/prometheus/wiki/Default-port-allocations
-		Path:           "/metrics",
-		VarnishstatExe: "varnishstat",
-		Params:         &varnishstatParams{},
+		ListenAddress:   ":9131", // Reserved and publicly announced at https://github.com/prometheus/prometheus/wiki/Default-port-allocations
+		ShutdownTimeout: 10 * time.Second,
+		ScrapeTimeout:   10 * time.Second,
+		Path:            "/metrics",
+		VarnishstatExe:  "varnishstat",
+		VarnishadmExe:   "varnishadm",
+		DescCacheIdle:   10,
+		LabelConflicts:  labelConflictPad,
+		Params:          &varnishstatParams{},
+		Docker:          &dockerParams{},
+		SSH:             &sshParams{Timeout: 10 * time.Second},
+		Discovery: &discoveryParams{
+			Interval:  time.Minute,
+			StateDirs: varnishDefaultStateDir,
+		},
+		Kubernetes: &kubernetesParams{
+			TokenFile: filepath.Join(kubernetesServiceAccountDir, "token"),
+			CAFile:    filepath.Join(kubernetesServiceAccountDir, "ca.crt"),
+		},
+		Textfile:   &textfileParams{Timeout: 10 * time.Second},
+		Privileges: &privilegeParams{},
 	}
-	logger *log.Logger
 )
 
 type startParams struct {
-	ListenAddress          string
-	Path                   string
-	HealthPath             string
-	VarnishstatExe         string
-	VarnishDockerContainer string
-	Params                 *varnishstatParams
+	ListenAddress   string
+	ShutdownTimeout time.Duration
+	ScrapeTimeout   time.Duration
+	Path            string
+	HealthPath      string
+	PanicPath       string
+	VarnishstatExe  string
+	VarnishadmExe   string
+	SkipColdVCLs    bool
+	BackendRules    string
+	BackendLabels   string
+	VCLActiveOnly   bool
+	VCLLabel        bool
+	DescCacheIdle   int
+	LabelConflicts  string
+	Params          *varnishstatParams
+	Docker          *dockerParams
+	Discovery       *discoveryParams
+	SSH             *sshParams
+	Kubernetes      *kubernetesParams
+	Textfile        *textfileParams
+	Privileges      *privilegeParams
 
 	Verbose       bool
 	ExitOnErrors  bool
@@ -59,43 +100,93 @@ func (p *varnishstatParams) isEmpty() bool {
 	return p.Instance == "" && p.VSM == ""
 }
 
-func (p *varnishstatParams) make() (params []string) {
+func (p *varnishstatParams) make(version *varnishVersion) (params []string) {
 	// -n
 	if p.Instance != "" {
 		params = append(params, "-n", p.Instance)
 	}
 	// -N is not supported by 3.x
-	if p.VSM != "" && VarnishVersion.EqualsOrGreater(4, 0) {
+	if p.VSM != "" && version.EqualsOrGreater(4, 0) {
 		params = append(params, "-N", p.VSM)
 	}
 	return params
 }
 
+// Subcommands, run as prometheus_varnish_exporter <command> [flags]
+var subcommands = map[string]func(args []string, stdout, stderr io.Writer) int{
+	"diff":      diffCommand,
+	"dashboard": dashboardCommand,
+	"mapping":   mappingCommand,
+	"rules":     rulesCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command := subcommands[os.Args[1]]; command != nil {
+			os.Exit(command(os.Args[2:], os.Stdout, os.Stderr))
+		}
+	}
+
 	// prometheus conventions
 	flag.StringVar(&StartParams.ListenAddress, "web.listen-address", StartParams.ListenAddress, "Address on which to expose metrics and web interface.")
 	flag.StringVar(&StartParams.Path, "web.telemetry-path", StartParams.Path, "Path under which to expose metrics.")
 	flag.StringVar(&StartParams.HealthPath, "web.health-path", StartParams.HealthPath, "Path under which to expose healthcheck. Disabled unless configured.")
+	flag.DurationVar(&StartParams.ShutdownTimeout, "web.shutdown-timeout", StartParams.ShutdownTimeout, "Time to wait for in-flight scrapes to finish on SIGTERM or SIGINT before aborting them.")
+	flag.DurationVar(&StartParams.ScrapeTimeout, "scrape.timeout", StartParams.ScrapeTimeout, "Time to wait for the varnishstat and varnishadm runs of a scrape target before killing them and reporting the target down. 0 waits until they exit.")
+	flag.StringVar(&StartParams.PanicPath, "web.panic-path", StartParams.PanicPath, "Path under which to expose the last captured varnishd panic. Disabled unless configured.")
 
 	// varnish
-	flag.StringVar(&StartParams.VarnishstatExe, "varnishstat-path", StartParams.VarnishstatExe, "Path to varnishstat.")
-	flag.StringVar(&StartParams.Params.Instance, "n", StartParams.Params.Instance, "varnishstat -n value.")
-	flag.StringVar(&StartParams.Params.VSM, "N", StartParams.Params.VSM, "varnishstat -N value.")
+	varnishFlags(flag.CommandLine)
+
+	// discovery
+	flag.BoolVar(&StartParams.Discovery.Enabled, "discovery", StartParams.Discovery.Enabled, "Discover and scrape all varnishd instances running on this host instead of the -n instance.")
+	flag.DurationVar(&StartParams.Discovery.Interval, "discovery.interval", StartParams.Discovery.Interval, "How often to look for new and stopped varnishd instances with -discovery.")
+	flag.StringVar(&StartParams.Discovery.StateDirs, "discovery.state-dirs", StartParams.Discovery.StateDirs, "Comma separated list of Varnish state directories to look for instance working directories in. Relative -n names are resolved in the first one.")
 
 	// docker
-	flag.StringVar(&StartParams.VarnishDockerContainer, "docker-container-name", StartParams.VarnishDockerContainer, "Docker container name to exec varnishstat in.")
+	flag.StringVar(&StartParams.Docker.ContainerName, "docker-container-name", StartParams.Docker.ContainerName, "Docker container name to exec varnishstat in.")
+	flag.StringVar(&StartParams.Docker.LabelSelector, "docker.label-selector", StartParams.Docker.LabelSelector, "Scrape varnishstat in the running containers with these comma separated labels, key or key=value. Disabled unless configured.")
+	flag.StringVar(&StartParams.Docker.ContainerLabels, "docker.container-labels", StartParams.Docker.ContainerLabels, "Comma separated list of container labels to add to the metrics as label_<name> with -docker.label-selector.")
+	flag.StringVar(&StartParams.Docker.Host, "docker.host", StartParams.Docker.Host, "Docker or Podman API address, e.g. unix:///run/podman/podman.sock or tcp://127.0.0.1:2375. Defaults to DOCKER_HOST or the first existing Docker or Podman socket.")
+
+	// ssh
+	flag.StringVar(&StartParams.SSH.Hosts, "ssh.hosts", StartParams.SSH.Hosts, "Comma separated list of [user@]host[:port] to run varnishstat on over SSH. Each host is a scrape target. Disabled unless configured.")
+	flag.StringVar(&StartParams.SSH.User, "ssh.user", StartParams.SSH.User, "SSH user for hosts without user@. Defaults to the current user.")
+	flag.StringVar(&StartParams.SSH.KeyFile, "ssh.key-file", StartParams.SSH.KeyFile, "SSH private key file. Defaults to the id_ed25519, id_ecdsa and id_rsa keys in ~/.ssh.")
+	flag.StringVar(&StartParams.SSH.KnownHosts, "ssh.known-hosts", StartParams.SSH.KnownHosts, "known_hosts file to verify the host keys with. Defaults to ~/.ssh/known_hosts.")
+	flag.DurationVar(&StartParams.SSH.Timeout, "ssh.timeout", StartParams.SSH.Timeout, "Timeout for connecting to SSH hosts.")
+
+	// kubernetes
+	flag.StringVar(&StartParams.Kubernetes.LabelSelector, "k8s.label-selector", StartParams.Kubernetes.LabelSelector, "Scrape varnishstat in the Kubernetes pods matching this label selector with the exec API. Disabled unless configured.")
+	flag.StringVar(&StartParams.Kubernetes.Namespace, "k8s.namespace", StartParams.Kubernetes.Namespace, "Kubernetes namespace of the pods. Defaults to the namespace the exporter runs in.")
+	flag.StringVar(&StartParams.Kubernetes.Container, "k8s.container", StartParams.Kubernetes.Container, "Container to exec varnishstat in. Defaults to the first container of the pod.")
+	flag.StringVar(&StartParams.Kubernetes.PodLabels, "k8s.pod-labels", StartParams.Kubernetes.PodLabels, "Comma separated list of pod labels to add to the metrics as label_<name>.")
+	flag.StringVar(&StartParams.Kubernetes.APIServer, "k8s.api-server", StartParams.Kubernetes.APIServer, "Kubernetes API server URL. Defaults to the in-cluster API server.")
+	flag.StringVar(&StartParams.Kubernetes.TokenFile, "k8s.token-file", StartParams.Kubernetes.TokenFile, "Bearer token file for the Kubernetes API.")
+	flag.StringVar(&StartParams.Kubernetes.CAFile, "k8s.ca-file", StartParams.Kubernetes.CAFile, "CA certificate file for the Kubernetes API.")
+
+	// textfile
+	flag.StringVar(&StartParams.Textfile.Directory, "textfile.directory", StartParams.Textfile.Directory, "Directory of *.prom files in the Prometheus text format and executables printing it, their metrics are added to each scrape. Disabled unless configured.")
+	flag.DurationVar(&StartParams.Textfile.Timeout, "textfile.timeout", StartParams.Textfile.Timeout, "Time to wait for a -textfile.directory executable before killing it.")
+
+	// privileges
+	flag.StringVar(&StartParams.Privileges.User, "privileges.user", StartParams.Privileges.User, "Switch to this user[:group] after listening when started as root, keeping the supplementary groups of the user such as varnish. Linux only. Disabled unless configured.")
+	flag.BoolVar(&StartParams.Privileges.Sudo, "privileges.sudo", StartParams.Privileges.Sudo, "Run varnishstat and varnishadm with sudo -n. The sudoers rule to allow a refused command line is logged.")
 
 	// modes
 	version := false
 	flag.BoolVar(&version, "version", version, "Print version and exit")
 	flag.BoolVar(&StartParams.ExitOnErrors, "exit-on-errors", StartParams.ExitOnErrors, "Exit process on scrape errors.")
-	flag.BoolVar(&StartParams.Verbose, "verbose", StartParams.Verbose, "Verbose logging.")
 	flag.BoolVar(&StartParams.Test, "test", StartParams.Test, "Test varnishstat availability, prints available metrics and exits.")
 	flag.BoolVar(&StartParams.Raw, "raw", StartParams.Test, "Raw stdout logging without timestamps.")
 	flag.BoolVar(&StartParams.WithGoMetrics, "with-go-metrics", StartParams.WithGoMetrics, "Export go runtime and http handler metrics")
 
+	// logging
+	logFlags(flag.CommandLine)
+
 	// deprecated
 	flag.BoolVar(&StartParams.noExit, "no-exit", StartParams.noExit, "Deprecated: see -exit-on-errors")
+	flag.BoolVar(&StartParams.Verbose, "verbose", StartParams.Verbose, "Deprecated: see -log.level and -log.debug")
 
 	flag.Parse()
 
@@ -104,41 +195,79 @@ func main() {
 		os.Exit(0)
 	}
 
-	logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	if StartParams.Verbose {
+		LogConfig.Level = "debug"
+	}
+	if err := LogConfig.Initialize(os.Stdout, StartParams.Raw); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 
 	if len(StartParams.Path) == 0 || StartParams.Path[0] != '/' {
-		logFatal("-web.telemetry-path cannot be empty and must start with a slash '/', given %q", StartParams.Path)
+		logFatal(logMain, "-web.telemetry-path cannot be empty and must start with a slash '/'", "path", StartParams.Path)
 	}
 	if len(StartParams.HealthPath) != 0 && StartParams.HealthPath[0] != '/' {
-		logFatal("-web.health-path must start with a slash '/' if configured, given %q", StartParams.HealthPath)
+		logFatal(logMain, "-web.health-path must start with a slash '/' if configured", "path", StartParams.HealthPath)
 	}
 	if StartParams.Path == StartParams.HealthPath {
-		logFatal("-web.telemetry-path and -web.health-path cannot have same value")
+		logFatal(logMain, "-web.telemetry-path and -web.health-path cannot have same value")
+	}
+	if err := applyVarnishFlags(); err != nil {
+		logFatal(logMain, "Invalid flags", "err", err)
+	}
+	if len(StartParams.PanicPath) != 0 {
+		if StartParams.PanicPath[0] != '/' {
+			logFatal(logMain, "-web.panic-path must start with a slash '/' if configured", "path", StartParams.PanicPath)
+		}
+		if StartParams.PanicPath == StartParams.Path || StartParams.PanicPath == StartParams.HealthPath {
+			logFatal(logMain, "-web.panic-path cannot have same value as -web.telemetry-path or -web.health-path")
+		}
 	}
 
 	// Don't log warning on !noExit as that would spam for the formed default value.
 	if StartParams.noExit {
-		logWarn("-no-exit is deprecated. As of v1.5 it is the default behavior not to exit process on scrape errors. You can remove this parameter.")
+		logMain.Warn("-no-exit is deprecated. As of v1.5 it is the default behavior not to exit process on scrape errors. You can remove this parameter.")
+	}
+	if StartParams.Verbose {
+		logMain.Warn("-verbose is deprecated. Use -log.level=debug or -log.debug=<subsystem> instead.")
 	}
 
 	// Test run or user explicitly wants to exit on any scrape errors during runtime.
 	ExitHandler.exitOnError = StartParams.Test == true || StartParams.ExitOnErrors == true
 
-	if b, err := json.MarshalIndent(StartParams, "", "  "); err == nil {
-		logInfo("%s %s %s", ApplicationName, getVersion(false), b)
-	} else {
-		logFatal(err.Error())
-	}
+	var flags []interface{}
+	flag.VisitAll(func(f *flag.Flag) {
+		flags = append(flags, slog.String(f.Name, f.Value.String()))
+	})
+	logMain.Info("Starting "+ApplicationName, "version", getVersion(false), slog.Group("flags", flags...))
+
+	// Stop on SIGINT and SIGTERM. Once stopping, the default signal
+	// handling is restored so a second signal exits immediately.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	// Initialize
-	if err := VarnishVersion.Initialize(); err != nil {
-		ExitHandler.Errorf("Varnish version initialize failed: %s", err.Error())
+	source, err := newTargetSource()
+	if err != nil {
+		logFatal(logMain, "Scrape target source initialize failed", "err", err)
+	}
+	if err := PrometheusExporter.Initialize(source); err != nil {
+		logFatal(logMain, "Prometheus exporter initialize failed", "err", err)
 	}
-	if VarnishVersion.Valid() {
-		logInfo("Found varnishstat %s", VarnishVersion)
-		if err := PrometheusExporter.Initialize(); err != nil {
-			logFatal("Prometheus exporter initialize failed: %s", err.Error())
+
+	// Listen before switching user, the address may need root
+	var listener net.Listener
+	if !StartParams.Test {
+		if listener, err = net.Listen("tcp", StartParams.ListenAddress); err != nil {
+			logFatal(logMain, "Listen failed", "err", err)
+		}
+	}
+	if StartParams.Privileges.enabled() {
+		u, err := dropPrivileges(StartParams.Privileges.User)
+		if err != nil {
+			logFatal(logMain, "Switching user failed", "user", StartParams.Privileges.User, "err", err)
 		}
+		logMain.Info("Switched user", "user", u.Username, "uid", os.Geteuid(), "gid", os.Getegid())
 	}
 
 	// Test to verify everything is ok before starting the server
@@ -148,24 +277,25 @@ func main() {
 		go func() {
 			for m := range metrics {
 				if StartParams.Test {
-					logInfo("%s", m.Desc())
+					logRaw("%s", m.Desc())
 				}
 			}
 			done <- true
 		}()
 		tStart := time.Now()
-		buf, err := ScrapeVarnish(metrics)
+		scrapeCtx := withLogAttrs(ctx, "scrape_id", atomic.AddUint64(&scrapeCounter, 1))
+		err := PrometheusExporter.Scrape(scrapeCtx, metrics)
 		close(metrics)
 		<-done
 
 		if err == nil {
-			logInfo("Test scrape done in %s", time.Now().Sub(tStart))
-			logRaw("")
+			logMain.Info("Test scrape done", "duration", time.Now().Sub(tStart))
 		} else {
-			if len(buf) > 0 {
-				logRaw("\n%s", buf)
+			for _, hint := range diagnoseVarnishAccess() {
+				logMain.Warn(hint)
 			}
 			ExitHandler.Errorf("Startup test: %s", err.Error())
+			exitOnFatalError()
 		}
 	}
 	if StartParams.Test {
@@ -173,24 +303,150 @@ func main() {
 	}
 
 	// Start serving
-	logInfo("Server starting on %s with metrics path %s", StartParams.ListenAddress, StartParams.Path)
+	logMain.Info("Server starting", "address", StartParams.ListenAddress, "path", StartParams.Path)
+
+	server := &http.Server{
+		Addr:     StartParams.ListenAddress,
+		Handler:  newServeMux(),
+		ErrorLog: stdLogger(logHTTP, slog.LevelError),
+	}
+	if err := serve(ctx, stop, server, listener, StartParams.ShutdownTimeout); err != nil {
+		logMain.Error("Exiting", "err", err)
+		os.Exit(1)
+	}
+	logMain.Info("Server stopped")
+}
+
+// Adds the flags of how varnishstat is run and its counters exported, shared with the subcommands.
+func varnishFlags(fs *flag.FlagSet) {
+	fs.StringVar(&StartParams.VarnishstatExe, "varnishstat-path", StartParams.VarnishstatExe, "Path to varnishstat.")
+	fs.StringVar(&StartParams.VarnishadmExe, "varnishadm-path", StartParams.VarnishadmExe, "Path to varnishadm. Used to fetch panic.show output when the child panics.")
+	fs.StringVar(&StartParams.Params.Instance, "n", StartParams.Params.Instance, "varnishstat -n value.")
+	fs.StringVar(&StartParams.Params.VSM, "N", StartParams.Params.VSM, "varnishstat -N value.")
+	fs.StringVar(&StartParams.BackendRules, "backend.name-rules", StartParams.BackendRules, "File of regular expressions, one per line, to parse backend names with. Named groups backend, server, director, host and port are the label values. Tried in order before the built-in rules.")
+	fs.StringVar(&StartParams.BackendLabels, "backend.labels", StartParams.BackendLabels, "Comma separated list of labels to add to backend metrics in addition to backend and server. Available labels: "+strings.Join(backendOptionalLabelKeys, ", ")+".")
+	fs.BoolVar(&StartParams.VCLLabel, "vcl.label", StartParams.VCLLabel, "Export the backends of all VCLs with a vcl label, instead of only the backends of the most recent reload_ VCL.")
+	fs.BoolVar(&StartParams.VCLActiveOnly, "vcl.active-only", StartParams.VCLActiveOnly, "Export only the backends of the active VCL. Runs varnishadm vcl.list on each scrape.")
+	fs.BoolVar(&StartParams.SkipColdVCLs, "vcl.skip-cold", StartParams.SkipColdVCLs, "Skip the backends of cold and discarded VCLs. Runs varnishadm vcl.list on each scrape.")
+	fs.IntVar(&StartParams.DescCacheIdle, "desc-cache.max-idle-scrapes", StartParams.DescCacheIdle, "Forget metric descriptors not used in this many scrapes, e.g. of removed backends. 0 keeps them until exit.")
+	fs.StringVar(&StartParams.LabelConflicts, "labels.conflict", StartParams.LabelConflicts, "How to export metrics with different labels than other metrics of the same name. One of: "+strings.Join(labelConflictPolicies, ", ")+".")
+}
 
+// Adds the logging flags, shared with the subcommands.
+func logFlags(fs *flag.FlagSet) {
+	fs.StringVar(&LogConfig.Level, "log.level", LogConfig.Level, "Only log messages with the given severity or above. One of: debug, info, warn, error.")
+	fs.StringVar(&LogConfig.Format, "log.format", LogConfig.Format, "Output format of log messages. One of: logfmt, json.")
+	fs.StringVar(&LogConfig.Debug, "log.debug", LogConfig.Debug, "Comma separated list of subsystems to log at debug level regardless of -log.level. Available subsystems: "+strings.Join(logSubsystems(), ", ")+".")
+}
+
+// Validates and applies the flags added by varnishFlags.
+func applyVarnishFlags() error {
+	if StartParams.DescCacheIdle < 0 {
+		return fmt.Errorf("-desc-cache.max-idle-scrapes cannot be negative: %d", StartParams.DescCacheIdle)
+	}
+	DescCache.SetMaxIdleScrapes(StartParams.DescCacheIdle)
+	if indexOf(labelConflictPolicies, StartParams.LabelConflicts) == -1 {
+		return fmt.Errorf("-labels.conflict must be one of: %s", strings.Join(labelConflictPolicies, ", "))
+	}
+	if StartParams.BackendRules != "" || StartParams.BackendLabels != "" {
+		var rules []string
+		if StartParams.BackendRules != "" {
+			var err error
+			if rules, err = readBackendNameRules(StartParams.BackendRules); err != nil {
+				return fmt.Errorf("-backend.name-rules read failed: %s", err)
+			}
+		}
+		var labels []string
+		for _, label := range strings.Split(StartParams.BackendLabels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				labels = append(labels, label)
+			}
+		}
+		parser, err := newBackendNameParser(rules, labels)
+		if err != nil {
+			return fmt.Errorf("Backend name rules initialize failed: %s", err)
+		}
+		BackendNames = parser
+	}
+	return nil
+}
+
+// Returns the scrape target source selected with the command line flags.
+func newTargetSource() (targetSource, error) {
+	var enabled []string
+	for flag, on := range map[string]bool{
+		"-k8s.label-selector":                              StartParams.Kubernetes.enabled(),
+		"-docker-container-name or -docker.label-selector": StartParams.Docker.enabled(),
+		"-discovery": StartParams.Discovery.Enabled,
+		"-ssh.hosts": StartParams.SSH.enabled(),
+	} {
+		if on {
+			enabled = append(enabled, flag)
+		}
+	}
+	if len(enabled) > 1 {
+		sort.Strings(enabled)
+		return nil, fmt.Errorf("only one of %s can be used", strings.Join(enabled, ", "))
+	}
+	if StartParams.Privileges.Sudo && len(enabled) == 1 && !StartParams.Discovery.Enabled {
+		return nil, fmt.Errorf("-privileges.sudo cannot be used with %s", enabled[0])
+	}
+
+	switch {
+	case StartParams.Kubernetes.enabled():
+		return newKubernetesSource(StartParams.Kubernetes)
+	case StartParams.Docker.enabled():
+		return newDockerSource(StartParams.Docker)
+	case StartParams.SSH.enabled():
+		return newSSHSource(StartParams.SSH)
+	case StartParams.Discovery.Enabled:
+		if StartParams.Params.Instance != "" {
+			return nil, fmt.Errorf("-discovery and -n cannot be used together")
+		}
+		return newDiscoverySource(StartParams.Discovery), nil
+	}
+	return newLocalSource(), nil
+}
+
+// Serves the metrics of a single scrape target with ?target=<name>, all targets otherwise.
+func targetHandler(all http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("target")
+		if name == "" {
+			all.ServeHTTP(w, r)
+			return
+		}
+		if !PrometheusExporter.HasTarget(r.Context(), name) {
+			http.Error(w, fmt.Sprintf("Unknown target %q", name), http.StatusNotFound)
+			return
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(PrometheusExporter.TargetCollector(name))
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+			ErrorLog: stdLogger(logHTTP, slog.LevelError),
+		}).ServeHTTP(w, r)
+	})
+}
+
+// Returns the HTTP handlers for metrics, health and panic paths.
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
 	if !StartParams.WithGoMetrics {
 		registry := prometheus.NewRegistry()
 		if err := registry.Register(PrometheusExporter); err != nil {
-			logFatal("registry.Register failed: %s", err.Error())
+			logFatal(logMain, "registry.Register failed", "err", err)
 		}
 		handler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
-			ErrorLog: logger,
+			ErrorLog: stdLogger(logHTTP, slog.LevelError),
 		})
-		http.Handle(StartParams.Path, handler)
+		mux.Handle(StartParams.Path, targetHandler(handler))
 	} else {
 		prometheus.MustRegister(PrometheusExporter)
-		http.Handle(StartParams.Path, promhttp.Handler())
+		mux.Handle(StartParams.Path, targetHandler(promhttp.Handler()))
 	}
 
 	if StartParams.Path != "/" {
-		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(`<html>
     <head><title>Varnish Exporter</title></head>
     <body>
@@ -201,20 +457,64 @@ func main() {
 		})
 	}
 	if StartParams.HealthPath != "" {
-		http.HandleFunc(StartParams.HealthPath, func(w http.ResponseWriter, r *http.Request) {
+		mux.HandleFunc(StartParams.HealthPath, func(w http.ResponseWriter, r *http.Request) {
 			// As noted in the "up" metric, needs some way to determine if everything is actually Ok.
 			// For now, this just lets us check that we're accepting connections
 			w.WriteHeader(http.StatusOK)
 			fmt.Fprintln(w, "Ok")
 		})
 	}
-	logFatalError(http.ListenAndServe(StartParams.ListenAddress, nil))
+	if StartParams.PanicPath != "" {
+		mux.Handle(StartParams.PanicPath, PrometheusExporter.panics)
+	}
+	return mux
+}
+
+// Serves on listener until ctx is done or a scrape fails with -exit-on-errors. On shutdown
+// new connections are refused and in-flight scrapes get timeout to finish,
+// after which they are aborted and their varnishstat processes killed.
+// Returns the error that caused the exit, nil on a signal.
+func serve(ctx context.Context, stop context.CancelFunc, server *http.Server, listener net.Listener, timeout time.Duration) (exitErr error) {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+		logMain.Info("Shutting down", "drain_timeout", timeout)
+	case exitErr = <-ExitHandler.Fatal():
+		logMain.Info("Shutting down on scrape error, -exit-on-errors is set", "drain_timeout", timeout)
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logMain.Warn("In-flight scrapes did not finish in time, aborting them", "err", err)
+		server.Close()
+		PrometheusExporter.Abort(5 * time.Second)
+	}
+	return exitErr
+}
+
+// Exits the process if a fatal error was set to ExitHandler.
+// Only used during startup when there are no scrapes in progress.
+func exitOnFatalError() {
+	select {
+	case <-ExitHandler.Fatal():
+		os.Exit(1)
+	default:
+	}
 }
 
 type exitHandler struct {
 	sync.RWMutex
 	exitOnError bool
 	err         error
+	fatal       chan error
 }
 
 func (ex *exitHandler) Errorf(format string, a ...interface{}) error {
@@ -228,6 +528,16 @@ func (ex *exitHandler) HasError() bool {
 	return hasError
 }
 
+// Fatal returns a channel that receives the first error set when exitOnError is enabled.
+func (ex *exitHandler) Fatal() <-chan error {
+	ex.Lock()
+	defer ex.Unlock()
+	if ex.fatal == nil {
+		ex.fatal = make(chan error, 1)
+	}
+	return ex.fatal
+}
+
 func (ex *exitHandler) Set(err error) error {
 	ex.Lock()
 	defer ex.Unlock()
@@ -240,10 +550,18 @@ func (ex *exitHandler) Set(err error) error {
 	errDiffers := ex.err == nil || ex.err.Error() != err.Error()
 	ex.err = err
 
+	if errDiffers || ex.exitOnError {
+		logScrape.Error("Scrape failed", "err", err)
+	}
 	if ex.exitOnError {
-		logFatal("%s", err.Error())
-	} else if errDiffers {
-		logError("%s", err.Error())
+		// Never exit from here, the process is stopped gracefully by whoever is listening.
+		if ex.fatal == nil {
+			ex.fatal = make(chan error, 1)
+		}
+		select {
+		case ex.fatal <- err:
+		default:
+		}
 	}
 	return err
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func testListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func Test_ServeGracefulShutdown(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.Write([]byte("varnish_up 1\n"))
+	})
+	listener := testListener(t)
+	server := &http.Server{Addr: listener.Addr().String(), Handler: mux}
+
+	ctx, stop := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, stop, server, listener, 5*time.Second)
+	}()
+
+	// Wait for the server to accept connections and start an in-flight scrape
+	response := make(chan string, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			resp, err := http.Get("http://" + server.Addr + "/metrics")
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			response <- string(body)
+			return
+		}
+		response <- ""
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape did not start")
+	}
+
+	stop()
+	time.Sleep(50 * time.Millisecond)
+	if _, err := net.DialTimeout("tcp", server.Addr, time.Second); err == nil {
+		t.Error("server still accepting connections while shutting down")
+	}
+	close(release)
+
+	if body := <-response; body != "varnish_up 1\n" {
+		t.Errorf("in-flight scrape did not finish, got %q", body)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve returned %s", err)
+	}
+}
+
+func Test_ServeExitOnErrors(t *testing.T) {
+	previous := ExitHandler
+	defer func() { ExitHandler = previous }()
+	ExitHandler = &exitHandler{exitOnError: true}
+
+	listener := testListener(t)
+	server := &http.Server{Addr: listener.Addr().String(), Handler: http.NewServeMux()}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, stop, server, listener, time.Second)
+	}()
+
+	scrapeErr := errors.New("varnishstat scrape failed: exit status 1")
+	ExitHandler.Set(scrapeErr)
+
+	select {
+	case err := <-served:
+		if err != scrapeErr {
+			t.Errorf("serve returned %v, expected %v", err, scrapeErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop on scrape error")
+	}
+}
+
+func Test_ExecuteVarnishToolCanceled(t *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		t.Skip("sleep not found")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := executeVarnishTool(ctx, sleep, "30"); err == nil {
+		t.Fatal("expected error from killed process")
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 5*time.Second {
+		t.Fatalf("process was not killed on cancel, took %s", elapsed)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Output formats of the mapping subcommand
+const (
+	mappingFormatText     = "text"
+	mappingFormatCSV      = "csv"
+	mappingFormatMarkdown = "markdown"
+)
+
+var mappingFormats = []string{mappingFormatText, mappingFormatCSV, mappingFormatMarkdown}
+
+var mappingHeader = []string{"varnish", "prometheus", "labels", "type", "help"}
+
+// mappingRow is a varnishstat counter and a metric it is exported as.
+type mappingRow struct {
+	counter string
+	name    string
+	labels  string
+	typ     string
+	help    string
+}
+
+func (r *mappingRow) fields() []string {
+	return []string{r.counter, r.name, r.labels, r.typ, r.help}
+}
+
+// Prints the Prometheus name, labels, type and help of each varnishstat counter,
+// from varnishstat or a varnishstat -j output file. Returns the exit code.
+func mappingCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("mapping", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("file", "", "varnishstat -j output file to read instead of running varnishstat.")
+	format := fs.String("format", mappingFormatText, "Output format. One of: "+strings.Join(mappingFormats, ", ")+".")
+	varnishFlags(fs)
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s mapping [flags]\n\nPrints the Prometheus name, labels, type and help each varnishstat counter is exported with.\n\n", ApplicationName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if indexOf(mappingFormats, *format) == -1 {
+		fmt.Fprintf(stderr, "-format must be one of: %s\n", strings.Join(mappingFormats, ", "))
+		return 2
+	}
+	if err := LogConfig.Initialize(stderr, StartParams.Raw); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := applyVarnishFlags(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	rows, err := mappingRows(context.Background(), *file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := writeMapping(stdout, *format, rows); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Returns the mapping of the counters in file, or of varnishstat if file is empty.
+func mappingRows(ctx context.Context, file string) ([]*mappingRow, error) {
+	metrics, err := scrapeGuardedMetrics(ctx, file)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]*mappingRow, 0, len(metrics))
+	for _, m := range metrics {
+		pairs := make([]string, len(m.labelKeys))
+		for i, key := range m.labelKeys {
+			pairs[i] = fmt.Sprintf("%s=%q", key, m.labelValues[i])
+		}
+		typ := "gauge"
+		if m.valueType == prometheus.CounterValue {
+			typ = "counter"
+		}
+		rows = append(rows, &mappingRow{
+			counter: m.counter,
+			name:    m.name,
+			labels:  strings.Join(pairs, ","),
+			typ:     typ,
+			help:    m.help,
+		})
+	}
+	// The derived metrics without a counter last
+	sort.SliceStable(rows, func(i, j int) bool {
+		if (rows[i].counter == "") != (rows[j].counter == "") {
+			return rows[j].counter == ""
+		}
+		return rows[i].counter < rows[j].counter
+	})
+	return rows, nil
+}
+
+// Returns the metrics of a scrape of file, or of varnishstat if file is empty, with
+// their varnishstat counters. The same as scraped by the exporter, labels resolved.
+// Metrics derived from several counters, such as varnish_storage_utilization_ratio,
+// have no counter.
+func scrapeGuardedMetrics(ctx context.Context, file string) ([]*guardedMetric, error) {
+	// Added by the single target as it is scraped
+	var metrics []*guardedMetric
+	guard := newLabelGuard(StartParams.LabelConflicts, nil, func(ctx context.Context, m *guardedMetric) {
+		metrics = append(metrics, m)
+	})
+	ctx = withLabelGuard(ctx, guard)
+
+	// The derived metrics not added to the guard are sent to ch
+	var derived []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			derived = append(derived, m)
+		}
+		close(done)
+	}()
+	scrape := func() error {
+		defer func() {
+			close(ch)
+			<-done
+		}()
+		if file != "" {
+			buf, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			target := newScrapeTarget(file, nil, nil, executeVarnishTool)
+			if _, err := ScrapeVarnishFrom(ctx, target, buf, ch, nil); err != nil {
+				return fmt.Errorf("%s: %s", file, err)
+			}
+			return nil
+		}
+		target := newLocalSource().target
+		if err := target.initializeVersion(ctx); err != nil {
+			return fmt.Errorf("Varnish version initialize failed: %s", err)
+		}
+		_, err := ScrapeVarnish(ctx, target, ch, nil)
+		return err
+	}
+	if err := scrape(); err != nil {
+		return nil, err
+	}
+	guard.Flush(ctx)
+
+	derivedMetrics, err := gatheredMetrics(derived)
+	if err != nil {
+		return nil, err
+	}
+	metrics = append(metrics, derivedMetrics...)
+	sort.SliceStable(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+	return metrics, nil
+}
+
+// metricsCollector collects the metrics as is, for gathering their names and help.
+type metricsCollector []prometheus.Metric
+
+func (c metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (c metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, m := range c {
+		ch <- m
+	}
+}
+
+// Returns the gauges and counters of metrics, without a varnishstat counter.
+func gatheredMetrics(metrics []prometheus.Metric) ([]*guardedMetric, error) {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(metricsCollector(metrics)); err != nil {
+		return nil, err
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	var gathered []*guardedMetric
+	for _, family := range families {
+		for _, pb := range family.GetMetric() {
+			m := &guardedMetric{name: family.GetName(), help: family.GetHelp()}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				m.valueType, m.value = prometheus.CounterValue, pb.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				m.valueType, m.value = prometheus.GaugeValue, pb.GetGauge().GetValue()
+			default:
+				continue
+			}
+			for _, label := range pb.GetLabel() {
+				m.labelKeys, m.labelValues = append(m.labelKeys, label.GetName()), append(m.labelValues, label.GetValue())
+			}
+			gathered = append(gathered, m)
+		}
+	}
+	return gathered, nil
+}
+
+func writeMapping(w io.Writer, format string, rows []*mappingRow) error {
+	switch format {
+	case mappingFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(mappingHeader)
+		for _, row := range rows {
+			cw.Write(row.fields())
+		}
+		cw.Flush()
+		return cw.Error()
+	case mappingFormatMarkdown:
+		escape := strings.NewReplacer("|", "\\|", "\n", " ")
+		fmt.Fprintf(w, "| %s |\n", strings.Join(mappingHeader, " | "))
+		fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(mappingHeader)))
+		for _, row := range rows {
+			fields := row.fields()
+			for i, field := range fields {
+				if field = escape.Replace(field); field != "" && i < 3 {
+					field = "`" + field + "`"
+				}
+				fields[i] = field
+			}
+			if _, err := fmt.Fprintf(w, "| %s |\n", strings.Join(fields, " | ")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(mappingHeader, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row.fields(), "\t"))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_MappingRows(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixture := filepath.Join(dir, "test/scrape/synthetic-7.6.1.json")
+	if !fileExists(fixture) {
+		t.Skipf("Cannot find test file %s", fixture)
+	}
+	rows, err := mappingRows(context.Background(), fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%d rows", len(rows))
+
+	byCounter := make(map[string][]*mappingRow)
+	for _, row := range rows {
+		byCounter[row.counter] = append(byCounter[row.counter], row)
+	}
+	for counter, expected := range map[string][]mappingRow{
+		"MAIN.uptime":    {{name: "varnish_main_uptime", typ: "counter", help: "Child process uptime"}},
+		"MAIN.sess_conn": {{name: "varnish_main_sessions", labels: `type="conn"`, typ: "counter", help: "Number of sessions"}},
+		"SMF.s0.g_bytes": {{name: "varnish_smf_g_bytes", labels: `type="s0"`, typ: "gauge", help: "Bytes outstanding"}},
+		// varnish_backend_up is derived from the happy bitmap
+		"VBE.reload_20210114_160902_21476.default.happy": {
+			{name: "varnish_backend_happy", labels: `backend="default",server="unknown"`, typ: "gauge", help: "Happy health probes"},
+			{name: "varnish_backend_up", labels: `backend="default",server="unknown"`, typ: "gauge", help: "Backend up as per the latest health probe"},
+		},
+	} {
+		got := byCounter[counter]
+		if len(got) != len(expected) {
+			t.Errorf("%s: expected %d rows, got %d", counter, len(expected), len(got))
+			continue
+		}
+		for i, row := range got {
+			t.Logf("%s -> %s{%s} %s %q", counter, row.name, row.labels, row.typ, row.help)
+			if row.name != expected[i].name || row.labels != expected[i].labels || row.typ != expected[i].typ || row.help != expected[i].help {
+				t.Errorf("%s: expected %+v, got %+v", counter, expected[i], *row)
+			}
+		}
+	}
+	// Derived from several counters, last
+	last := rows[len(rows)-1]
+	if expected := `stevedore="smf",storage="s0"`; last.counter != "" || last.name != "varnish_storage_utilization_ratio" || last.labels != expected || last.typ != "gauge" {
+		t.Errorf("expected varnish_storage_utilization_ratio{%s} last, got %+v", expected, *last)
+	}
+	// Backends of the previous VCLs are not exported
+	for counter := range byCounter {
+		if strings.HasPrefix(counter, "VBE.boot.") {
+			t.Errorf("unexpected %s", counter)
+		}
+	}
+}
+
+func Test_MappingCommand(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixture := filepath.Join(dir, "test/scrape/6.5.1.json")
+	if !fileExists(fixture) {
+		t.Skipf("Cannot find test file %s", fixture)
+	}
+	t.Cleanup(func() {
+		LogConfig.Initialize(os.Stdout, false)
+	})
+	rows, err := mappingRows(context.Background(), fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) (int, string, string) {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		code := mappingCommand(args, stdout, stderr)
+		return code, stdout.String(), stderr.String()
+	}
+
+	code, out, errOut := run("-file", fixture, "-format", "csv")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(rows)+1 || !matchStringSlices(records[0], mappingHeader) {
+		t.Errorf("expected header and %d rows, got %d records", len(rows), len(records))
+	}
+
+	code, out, errOut = run("-file", fixture, "-format", "markdown")
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	t.Logf("%s\n%s\n%s", lines[0], lines[1], lines[2])
+	if len(lines) != len(rows)+2 || lines[1] != "| --- | --- | --- | --- | --- |" {
+		t.Errorf("expected header, separator and %d rows, got %d lines", len(rows), len(lines))
+	}
+	for _, line := range lines {
+		if strings.Count(line, " | ")-strings.Count(line, `\|`) != len(mappingHeader)-1 {
+			t.Errorf("expected %d columns: %s", len(mappingHeader), line)
+		}
+	}
+
+	code, out, errOut = run("-file", fixture)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, errOut)
+	}
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != len(rows)+1 || !strings.HasPrefix(lines[0], "VARNISH ") {
+		t.Errorf("expected header and %d rows, got %d lines", len(rows), len(lines))
+	}
+
+	if code, _, _ := run("-file", fixture, "-format", "xml"); code != 2 {
+		t.Errorf("expected exit 2 on invalid format, got %d", code)
+	}
+	if code, _, errOut := run("-file", filepath.Join(dir, "test/scrape/missing.json")); code != 1 || errOut == "" {
+		t.Errorf("expected exit 1 with error on missing file, got %d %q", code, errOut)
+	}
+}
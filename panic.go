@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// "Assert error in VBO_DerefBusyObj(), cache/cache_busyobj.c line 212:"
+	regexPanicLocation = regexp.MustCompile(`^(Assert error|Wrong turn|Missing errorhandling code|Incomplete code|Panic) in ([^,]*), (\S+) line (\d+)`)
+)
+
+// varnishPanic is the parsed output of 'varnishadm panic.show'.
+type varnishPanic struct {
+	Time     time.Time // when the child panicked, capture time if not reported by varnish
+	Captured time.Time
+	Kind     string // "Assert error", "Wrong turn" etc.
+	Function string
+	Location string // "<file> line <number>"
+	Thread   string
+	Text     string // full panic.show output
+}
+
+// Parses 'varnishadm panic.show' output.
+func parseVarnishPanic(text string, captured time.Time) (*varnishPanic, error) {
+	text = strings.TrimSpace(strings.Replace(text, "\r\n", "\n", -1))
+	if len(text) == 0 {
+		return nil, fmt.Errorf("empty panic.show output")
+	}
+	p := &varnishPanic{
+		Time:     captured,
+		Captured: captured,
+		Text:     text,
+	}
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.Trim(strings.TrimSpace(scanner.Text()), `"`)
+		switch {
+		case strings.HasPrefix(line, "Last panic at:"), strings.HasPrefix(line, "Panic at:"):
+			value := strings.TrimSpace(line[strings.Index(line, ":")+1:])
+			if t, err := time.Parse(time.RFC1123, value); err == nil {
+				p.Time = t
+			}
+		case strings.HasPrefix(line, "thread = ") && p.Thread == "":
+			p.Thread = strings.Trim(strings.TrimPrefix(line, "thread = "), "()")
+		case p.Kind == "":
+			if match := regexPanicLocation.FindStringSubmatch(line); match != nil {
+				p.Kind, p.Function = match[1], match[2]
+				p.Location = match[3] + " line " + match[4]
+			}
+		}
+	}
+	return p, scanner.Err()
+}
+
+// Summary line used in logging.
+func (p *varnishPanic) Summary() string {
+	if p.Kind == "" {
+		return fmt.Sprintf("panic at %s", p.Time.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s in %s, %s at %s (thread %s)", p.Kind, p.Function, p.Location, p.Time.Format(time.RFC3339), p.Thread)
+}
+
+// panicCapture fetches the panic message with varnishadm when
+// MGT.child_panic of a target increases and keeps the latest one around.
+type panicCapture struct {
+	sync.RWMutex
+
+	states    map[string]*panicState // by target name
+	timestamp *prometheus.Desc
+
+	// Overridden in tests
+	fetch func(ctx context.Context, target *scrapeTarget) (string, error)
+}
+
+type panicState struct {
+	target   *scrapeTarget
+	captured float64 // MGT.child_panic the last panic was fetched at
+	fetching bool
+	failures int // fetches failed since the last capture
+	last     *varnishPanic
+}
+
+// The metrics are labeled with labelKeys, see targetSource.
+func newPanicCapture(labelKeys []string) *panicCapture {
+	return &panicCapture{
+		states: make(map[string]*panicState),
+		timestamp: prometheus.NewDesc(
+			exporterNamespace+"_last_panic_timestamp_seconds",
+			"Unix timestamp of the last varnishd child panic captured with varnishadm panic.show.",
+			labelKeys, nil,
+		),
+		fetch: fetchVarnishPanic,
+	}
+}
+
+// Observe checks MGT.child_panic from the tracked scrape counters of target and
+// fetches the panic in the background if it is above the count of the last capture.
+// A failed fetch is retried on the next scrape. A non-zero count on the first scrape
+// also triggers a fetch, the panic happened before we were started.
+func (pc *panicCapture) Observe(ctx context.Context, target *scrapeTarget, counters map[string]float64) {
+	count, ok := counters["MGT.child_panic"]
+	if !ok {
+		return
+	}
+	pc.Lock()
+	state := pc.states[target.name]
+	if state == nil {
+		state = &panicState{target: target}
+		pc.states[target.name] = state
+	}
+	if count < state.captured {
+		// The management process restarted
+		state.captured = count
+	}
+	if count <= state.captured || state.fetching {
+		pc.Unlock()
+		return
+	}
+	state.fetching = true
+	pc.Unlock()
+
+	go pc.capture(ctx, state, count)
+}
+
+func (pc *panicCapture) capture(ctx context.Context, state *panicState, count float64) {
+	defer func() {
+		pc.Lock()
+		state.fetching = false
+		pc.Unlock()
+	}()
+
+	fetchCtx := ctx
+	if StartParams.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		fetchCtx, cancel = context.WithTimeout(ctx, StartParams.ScrapeTimeout)
+		defer cancel()
+	}
+	text, err := pc.fetch(fetchCtx, state.target)
+	if err != nil {
+		pc.Lock()
+		state.failures++
+		failures := state.failures
+		pc.Unlock()
+
+		args := []interface{}{"varnishadm", StartParams.VarnishadmExe, "failures", failures, "err", err}
+		if failures == 1 {
+			logPanic.WarnContext(ctx, "Failed to fetch varnishd panic with panic.show, retrying on the next scrapes", args...)
+		} else {
+			logPanic.DebugContext(ctx, "Failed to fetch varnishd panic with panic.show", args...)
+		}
+		return
+	}
+	pc.Lock()
+	state.captured, state.failures = count, 0
+	pc.Unlock()
+
+	// Not retried, the panic was cleared or the output is not one
+	p, err := parseVarnishPanic(text, time.Now())
+	if err != nil {
+		logPanic.WarnContext(ctx, "Failed to parse varnishd panic", "err", err)
+		return
+	}
+	pc.Lock()
+	state.last = p
+	pc.Unlock()
+
+	logPanic.ErrorContext(ctx, "Varnish child panic captured", "summary", p.Summary(), "panic", p.Text)
+}
+
+// Last returns the latest captured panic of the named target, nil if none.
+func (pc *panicCapture) Last(name string) *varnishPanic {
+	pc.RLock()
+	defer pc.RUnlock()
+	if state := pc.states[name]; state != nil {
+		return state.last
+	}
+	return nil
+}
+
+// Forget drops the state of a removed target.
+func (pc *panicCapture) Forget(target *scrapeTarget) {
+	pc.Lock()
+	defer pc.Unlock()
+	delete(pc.states, target.name)
+}
+
+func (pc *panicCapture) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pc.timestamp
+}
+
+func (pc *panicCapture) Collect(ch chan<- prometheus.Metric) {
+	pc.RLock()
+	defer pc.RUnlock()
+	for _, state := range pc.states {
+		if state.last != nil {
+			ch <- prometheus.MustNewConstMetric(pc.timestamp, prometheus.GaugeValue, float64(state.last.Time.Unix()), state.target.labelValues...)
+		}
+	}
+}
+
+// Implements http.Handler, serves the latest captured panic of each target as plain text.
+// Use ?target=<name> to only show one target.
+func (pc *panicCapture) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	filter := r.URL.Query().Get("target")
+	pc.RLock()
+	var states []*panicState
+	for name, state := range pc.states {
+		if state.last != nil && (filter == "" || filter == name) {
+			states = append(states, state)
+		}
+	}
+	pc.RUnlock()
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].target.name < states[j].target.name
+	})
+
+	if len(states) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintln(w, "No varnishd panic captured")
+		return
+	}
+	for i, state := range states {
+		p := state.last
+		if i > 0 {
+			fmt.Fprintf(w, "\n%s\n\n", strings.Repeat("-", 80))
+		}
+		if len(state.target.labelKeys) > 0 {
+			fmt.Fprintf(w, "Target:      %s\n", state.target.name)
+		}
+		fmt.Fprintf(w, "Panic at:    %s\n", p.Time.Format(time.RFC1123))
+		fmt.Fprintf(w, "Captured at: %s\n", p.Captured.Format(time.RFC1123))
+		if p.Kind != "" {
+			fmt.Fprintf(w, "Location:    %s in %s, %s\n", p.Kind, p.Function, p.Location)
+		}
+		if p.Thread != "" {
+			fmt.Fprintf(w, "Thread:      %s\n", p.Thread)
+		}
+		fmt.Fprintf(w, "\n%s\n", p.Text)
+	}
+}
+
+// Returns the output of 'varnishadm panic.show' of target.
+func fetchVarnishPanic(ctx context.Context, target *scrapeTarget) (string, error) {
+	var params []string
+	if target.params.Instance != "" {
+		params = append(params, "-n", target.params.Instance)
+	}
+	params = append(params, "panic.show")
+	buf, err := target.exec(ctx, StartParams.VarnishadmExe, params...)
+	if err != nil {
+		if out := strings.TrimSpace(buf.String()); out != "" {
+			return "", fmt.Errorf("%s: %s", err, out)
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPanicShow = `Panic at: Tue, 09 Feb 2021 08:33:12 GMT
+Assert error in ved_stripgzip(), cache/cache_esi_deliver.c line 647:
+  Condition(l > 0) not true.
+version = varnish-6.0.7 revision 525d371e3ea0e0c38edd7baf0f80dc226560f26e, vrt api = 7.1
+ident = Linux,4.15.0-132-generic,x86_64,-junix,-smalloc,-sdefault,-hcritbit,epoll
+now = 1824883.562367 (mono), 1612859592.139873 (real)
+Backtrace:
+  0x43e4f5: varnishd() [0x43e4f5]
+  0x4a0c52: varnishd(VAS_Fail+0x42) [0x4a0c52]
+  0x42a5e4: varnishd() [0x42a5e4]
+thread = (cache-worker)
+thr.req = 0x7f1b2c00a020 {
+  vxid = 32770, transport = HTTP/1
+}
+`
+
+func Test_ParseVarnishPanic(t *testing.T) {
+	captured := time.Unix(1700000000, 0)
+	p, err := parseVarnishPanic(testPanicShow, captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("%s\n", p.Summary())
+
+	if expected := time.Date(2021, 2, 9, 8, 33, 12, 0, time.UTC); !p.Time.Equal(expected) {
+		t.Errorf("time %s != %s", p.Time, expected)
+	}
+	if p.Kind != "Assert error" {
+		t.Errorf("kind %q", p.Kind)
+	}
+	if p.Function != "ved_stripgzip()" {
+		t.Errorf("function %q", p.Function)
+	}
+	if p.Location != "cache/cache_esi_deliver.c line 647" {
+		t.Errorf("location %q", p.Location)
+	}
+	if p.Thread != "cache-worker" {
+		t.Errorf("thread %q", p.Thread)
+	}
+
+	// No timestamp or location, fall back to capture time
+	p, err = parseVarnishPanic("Child not responding\n", captured)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Time.Equal(captured) || p.Kind != "" {
+		t.Errorf("unexpected parse result %#v", p)
+	}
+
+	if _, err = parseVarnishPanic("  \n", captured); err == nil {
+		t.Error("expected error from empty output")
+	}
+}
+
+func Test_PanicCapture(t *testing.T) {
+	fetched := make(chan bool, 10)
+	pc := newPanicCapture(nil)
+	pc.fetch = func(ctx context.Context, target *scrapeTarget) (string, error) {
+		fetched <- true
+		return testPanicShow, nil
+	}
+	waitFetch := func() {
+		select {
+		case <-fetched:
+		case <-time.After(5 * time.Second):
+			t.Fatal("panic was not fetched")
+		}
+		// wait for the background capture to store the result
+		for i := 0; i < 100; i++ {
+			pc.RLock()
+			fetching := pc.states[testTarget.name].fetching
+			pc.RUnlock()
+			if !fetching {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("panic capture did not finish")
+	}
+
+	// Nothing captured yet
+	rec := httptest.NewRecorder()
+	pc.ServeHTTP(rec, httptest.NewRequest("GET", "/panic", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status %d != %d", rec.Code, http.StatusNotFound)
+	}
+
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 0})
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 0})
+	if len(fetched) != 0 || pc.Last(testTarget.name) != nil {
+		t.Fatal("fetched panic without child_panic increasing")
+	}
+
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 1})
+	waitFetch()
+	if pc.Last(testTarget.name) == nil {
+		t.Fatal("panic not captured")
+	}
+
+	rec = httptest.NewRecorder()
+	pc.ServeHTTP(rec, httptest.NewRequest("GET", "/panic", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d != %d", rec.Code, http.StatusOK)
+	}
+	body := rec.Body.String()
+	for _, expected := range []string{"Location:    Assert error in ved_stripgzip(), cache/cache_esi_deliver.c line 647", "Backtrace:", "thread = (cache-worker)"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("response does not contain %q:\n%s", expected, body)
+		}
+	}
+
+	// Already running exporter with a panicked child, fetch on first observe
+	pc = newPanicCapture(nil)
+	pc.fetch = func(ctx context.Context, target *scrapeTarget) (string, error) {
+		fetched <- true
+		return testPanicShow, nil
+	}
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 2})
+	waitFetch()
+
+	// A failed fetch is retried on the next scrape with the same count, not after a capture
+	pc = newPanicCapture(nil)
+	fail := true
+	pc.fetch = func(ctx context.Context, target *scrapeTarget) (string, error) {
+		fetched <- true
+		if fail {
+			return "", errors.New("Authentication required")
+		}
+		return testPanicShow, nil
+	}
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 0})
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 1})
+	waitFetch()
+	if pc.Last(testTarget.name) != nil {
+		t.Fatal("unexpected panic captured from a failed fetch")
+	}
+	fail = false
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 1})
+	waitFetch()
+	if pc.Last(testTarget.name) == nil {
+		t.Fatal("panic not captured on retry")
+	}
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 1})
+	if len(fetched) != 0 {
+		t.Fatal("fetched the captured panic again")
+	}
+
+	// The count of a restarted management process starts over
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 0})
+	pc.Observe(context.Background(), testTarget, map[string]float64{"MGT.child_panic": 1})
+	waitFetch()
+}
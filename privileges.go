@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+	"os/user"
+	"strings"
+)
+
+type privilegeParams struct {
+	User string // user[:group] to switch to after startup
+	Sudo bool   // run varnishstat and varnishadm with sudo -n
+}
+
+func (p *privilegeParams) enabled() bool {
+	return p.User != ""
+}
+
+// Returns the executor of the local varnishstat and varnishadm, with -privileges.sudo through sudo.
+func localExecutor() toolExecutor {
+	if StartParams.Privileges.Sudo {
+		return sudoExecutor(executeVarnishTool)
+	}
+	return executeVarnishTool
+}
+
+// Returns exec running the tools with sudo -n, except varnishstat -V that needs no access to the
+// VSM. The tool is run by its absolute path with the exact params for a sudoers rule to match the
+// whole command line. When sudo refuses to run it, the rule that allows it is logged.
+func sudoExecutor(exec toolExecutor) toolExecutor {
+	return func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+		if exe == StartParams.VarnishstatExe && len(params) == 1 && params[0] == "-V" {
+			return exec(ctx, exe, params...)
+		}
+		path := lookPath(exe)
+		buf, err := exec(ctx, "sudo", append([]string{"-n", "--", path}, params...)...)
+		if err != nil && strings.HasPrefix(firstLine(buf.String()), "sudo:") {
+			logScrape.WarnContext(ctx, "sudo refused to run "+exe+", allow it with a sudoers rule, e.g. in /etc/sudoers.d/"+ApplicationName,
+				"rule", sudoersRule(currentUsername(), path, params))
+		}
+		return buf, err
+	}
+}
+
+// Returns a sudoers rule allowing username to run path with exactly params as root.
+func sudoersRule(username, path string, params []string) string {
+	command := []string{sudoersEscape(path)}
+	for _, param := range params {
+		command = append(command, sudoersEscape(param))
+	}
+	return username + " ALL=(root) NOPASSWD: " + strings.Join(command, " ")
+}
+
+// Escapes the characters that are special in sudoers command arguments.
+func sudoersEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\,:=`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Returns the absolute path of exe as found in PATH, exe itself if not found.
+func lookPath(exe string) string {
+	if path, err := exec.LookPath(exe); err == nil {
+		return path
+	}
+	return exe
+}
+
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "prometheus"
+}
+
+// Returns hints on why the startup test scrape of the local varnishd failed, from the access
+// of the current user to the VSM directories. None for remote targets and with -privileges.sudo,
+// for which sudo errors are logged by the scrape.
+func diagnoseVarnishAccess() []string {
+	if StartParams.Kubernetes.enabled() || StartParams.Docker.enabled() || StartParams.SSH.enabled() || StartParams.Privileges.Sudo {
+		return nil
+	}
+	discovery := newDiscoverySource(StartParams.Discovery)
+	if StartParams.Discovery.Enabled {
+		return diagnoseVSMAccess(discovery.stateDirs)
+	}
+	workdir := discovery.defaultWorkdir()
+	if StartParams.Params.Instance != "" {
+		workdir = discovery.workdir(StartParams.Params.Instance)
+	}
+	return diagnoseVSMAccess([]string{workdir})
+}
@@ -0,0 +1,148 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Switches the process to the user and group of spec, user[:group], keeping the supplementary
+// groups of the user such as varnish. Without a group the primary group of the user is used.
+// Started as another user than root, only switching to the current user succeeds.
+func dropPrivileges(spec string) (*user.User, error) {
+	name, groupName, _ := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return nil, err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if os.Geteuid() != 0 {
+		if os.Geteuid() == uid && os.Getegid() == gid {
+			return u, nil
+		}
+		return nil, fmt.Errorf("switching to %s needs the exporter to be started as root", spec)
+	}
+
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("groups of %s: %s", name, err)
+	}
+	gids := []int{gid}
+	for _, id := range groupIDs {
+		if id, err := strconv.Atoi(id); err == nil && id != gid {
+			gids = append(gids, id)
+		}
+	}
+	// Since Go 1.16 these apply to all threads of the process
+	if err := syscall.Setgroups(gids); err != nil {
+		return nil, fmt.Errorf("setgroups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return nil, fmt.Errorf("setgid: %s", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return nil, fmt.Errorf("setuid: %s", err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return nil, fmt.Errorf("root privileges could be regained after switching to %s", spec)
+	}
+	return u, nil
+}
+
+// vsmAccess is the user and groups the VSM directories are accessed with.
+type vsmAccess struct {
+	username string
+	uid      uint32
+	gids     map[uint32]bool
+}
+
+func currentVSMAccess() *vsmAccess {
+	a := &vsmAccess{
+		username: currentUsername(),
+		uid:      uint32(os.Geteuid()),
+		gids:     map[uint32]bool{uint32(os.Getegid()): true},
+	}
+	groups, _ := os.Getgroups()
+	for _, gid := range groups {
+		a.gids[uint32(gid)] = true
+	}
+	return a
+}
+
+func diagnoseVSMAccess(dirs []string) []string {
+	return currentVSMAccess().diagnose(dirs)
+}
+
+// Returns a hint for each working or state directory that is missing or that the
+// user can't read, checked with the VSM subdirectories of Varnish 6 and newer.
+func (a *vsmAccess) diagnose(dirs []string) (hints []string) {
+	for _, dir := range dirs {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			hints = append(hints, fmt.Sprintf("VSM directory %s does not exist. Check that varnishd is running and that -n is the varnishd -n value.", dir))
+			continue
+		} else if err != nil {
+			hints = append(hints, fmt.Sprintf("Cannot access VSM directory %s: %s. The directories above it must be searchable by user %s.", dir, err, a.username))
+			continue
+		}
+		for _, path := range []string{dir, filepath.Join(dir, "_.vsm_mgt"), filepath.Join(dir, "_.vsm_child")} {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if hint := a.diagnosePath(path, info); hint != "" {
+				hints = append(hints, hint)
+				break
+			}
+		}
+	}
+	return hints
+}
+
+// Returns why the user can't list and read the directory at path, empty if it can.
+func (a *vsmAccess) diagnosePath(path string, info os.FileInfo) string {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || a.uid == 0 {
+		return ""
+	}
+	mode := info.Mode().Perm()
+	group := groupName(st.Gid)
+	switch {
+	case st.Uid == a.uid:
+		if mode&0500 == 0500 {
+			return ""
+		}
+		return fmt.Sprintf("%s is owned by user %s, but its mode %s does not allow the owner to read it.", path, a.username, mode)
+	case a.gids[st.Gid]:
+		if mode&0050 == 0050 {
+			return ""
+		}
+		return fmt.Sprintf("%s mode %s does not allow its group %s to read it. Check the umask varnishd is started with.", path, mode, group)
+	case mode&0005 == 0005:
+		return ""
+	}
+	return fmt.Sprintf("User %s cannot read %s of group %s with mode %s. Add the user to the group with `usermod -aG %s %s` and restart the exporter, or see -privileges.user and -privileges.sudo.",
+		a.username, path, group, mode, group, a.username)
+}
+
+// Returns the name of the group, its id if not found.
+func groupName(gid uint32) string {
+	id := strconv.FormatUint(uint64(gid), 10)
+	if g, err := user.LookupGroupId(id); err == nil {
+		return g.Name
+	}
+	return id
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func Test_DiagnoseVSMAccess(t *testing.T) {
+	dir := t.TempDir()
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, group := info.Sys().(*syscall.Stat_t).Uid, info.Sys().(*syscall.Stat_t).Gid
+	// Root can read everything, the owner is checked with another user
+	varnishUID := owner
+	if varnishUID == 0 {
+		varnishUID = 4242
+	}
+
+	other := &vsmAccess{username: "exporter", uid: owner + 1000, gids: map[uint32]bool{group + 1000: true}}
+	member := &vsmAccess{username: "exporter", uid: owner + 1000, gids: map[uint32]bool{group: true}}
+	ownerAccess := &vsmAccess{username: "varnish", uid: varnishUID, gids: map[uint32]bool{}}
+	root := &vsmAccess{username: "root", uid: 0, gids: map[uint32]bool{0: true}}
+
+	for _, test := range []struct {
+		name     string
+		access   *vsmAccess
+		chown    bool                   // to the varnish user
+		modes    map[string]os.FileMode // of the workdir and its subdirectories
+		expected string                 // in the hint, no hint if empty
+	}{
+		{"readable by others", other, false, map[string]os.FileMode{".": 0755}, ""},
+		{"not in the group", other, false, map[string]os.FileMode{".": 0750}, "usermod -aG " + groupName(group) + " exporter"},
+		{"in the group", member, false, map[string]os.FileMode{".": 0750}, ""},
+		{"group not allowed", member, false, map[string]os.FileMode{".": 0700}, "does not allow its group"},
+		{"owner not allowed", ownerAccess, true, map[string]os.FileMode{".": 0300}, "does not allow the owner"},
+		{"root", root, false, map[string]os.FileMode{".": 0700}, ""},
+		{"vsm subdirectory", other, false, map[string]os.FileMode{".": 0755, "_.vsm_mgt": 0755, "_.vsm_child": 0750}, "_.vsm_child of group"},
+	} {
+		workdir := filepath.Join(dir, strings.Replace(test.name, " ", "_", -1))
+		for name, mode := range test.modes {
+			path := filepath.Join(workdir, name)
+			if err := os.MkdirAll(path, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chmod(path, mode); err != nil {
+				t.Fatal(err)
+			}
+			if test.chown && varnishUID != owner {
+				if err := os.Chown(path, int(varnishUID), -1); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		hints := test.access.diagnose([]string{workdir})
+		t.Logf("%s: %q", test.name, hints)
+		if test.expected == "" && len(hints) != 0 {
+			t.Errorf("%s: expected no hints, got %q", test.name, hints)
+		} else if test.expected != "" && (len(hints) != 1 || !strings.Contains(hints[0], test.expected)) {
+			t.Errorf("%s: expected a hint with %q, got %q", test.name, test.expected, hints)
+		}
+	}
+
+	hints := other.diagnose([]string{filepath.Join(dir, "missing")})
+	if len(hints) != 1 || !strings.Contains(hints[0], "does not exist") {
+		t.Errorf("expected a missing directory hint, got %q", hints)
+	}
+}
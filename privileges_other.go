@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+)
+
+func dropPrivileges(spec string) (*user.User, error) {
+	return nil, fmt.Errorf("-privileges.user is only supported on Linux")
+}
+
+func diagnoseVSMAccess(dirs []string) []string {
+	return nil
+}
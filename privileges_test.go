@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_SudoExecutor(t *testing.T) {
+	previous := StartParams.VarnishstatExe
+	StartParams.VarnishstatExe = "/opt/varnish/bin/varnishstat"
+	logs := &bytes.Buffer{}
+	if err := LogConfig.Initialize(logs, true); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		StartParams.VarnishstatExe = previous
+		LogConfig.Initialize(os.Stdout, false)
+	})
+
+	var commands []string
+	output := ""
+	exec := sudoExecutor(func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+		commands = append(commands, strings.Join(append([]string{exe}, params...), " "))
+		if output != "" {
+			return bytes.NewBufferString(output), errors.New("exit status 1")
+		}
+		return &bytes.Buffer{}, nil
+	})
+
+	exec(context.Background(), StartParams.VarnishstatExe, "-V")
+	exec(context.Background(), StartParams.VarnishstatExe, "-j", "-t", "0", "-n", "/var/lib/varnish/a,b")
+	expected := []string{
+		"/opt/varnish/bin/varnishstat -V",
+		"sudo -n -- /opt/varnish/bin/varnishstat -j -t 0 -n /var/lib/varnish/a,b",
+	}
+	if !matchStringSlices(commands, expected) {
+		t.Errorf("expected %q, got %q", expected, commands)
+	}
+	if logs.Len() != 0 {
+		t.Errorf("unexpected logs: %s", logs)
+	}
+
+	// The sudoers rule is logged when sudo refuses to run the command
+	output = "sudo: a password is required\n"
+	if _, err := exec(context.Background(), StartParams.VarnishstatExe, "-j", "-n", "/var/lib/varnish/a,b"); err == nil {
+		t.Error("expected an error")
+	}
+	rule := currentUsername() + ` ALL=(root) NOPASSWD: /opt/varnish/bin/varnishstat -j -n /var/lib/varnish/a\,b`
+	t.Log(logs.String())
+	if !strings.Contains(logs.String(), strconv.Quote(rule)) {
+		t.Errorf("expected the sudoers rule %s to be logged", rule)
+	}
+
+	// Errors of the command itself are not sudo errors
+	logs.Reset()
+	output = "Could not get hold of varnishd, is it running?\n"
+	exec(context.Background(), StartParams.VarnishstatExe, "-j")
+	if logs.Len() != 0 {
+		t.Errorf("unexpected logs: %s", logs)
+	}
+}
+
+func Test_SudoersRule(t *testing.T) {
+	for _, test := range []struct {
+		params   []string
+		expected string
+	}{
+		{nil, `prometheus ALL=(root) NOPASSWD: /usr/bin/varnishadm`},
+		{[]string{"-n", "varnishd", "panic.show"}, `prometheus ALL=(root) NOPASSWD: /usr/bin/varnishadm -n varnishd panic.show`},
+		{[]string{"-n", `C:\a=b:c`}, `prometheus ALL=(root) NOPASSWD: /usr/bin/varnishadm -n C\:\\a\=b\:c`},
+	} {
+		if actual := sudoersRule("prometheus", "/usr/bin/varnishadm", test.params); actual != test.expected {
+			t.Errorf("%q: expected %s, got %s", test.params, test.expected, actual)
+		}
+	}
+}
+
+func Test_PrivilegesSudoRemoteSource(t *testing.T) {
+	previous := *StartParams.Privileges
+	previousSSH := *StartParams.SSH
+	t.Cleanup(func() {
+		*StartParams.Privileges = previous
+		*StartParams.SSH = previousSSH
+	})
+	StartParams.Privileges.Sudo = true
+	StartParams.SSH.Hosts = "varnish1"
+
+	if _, err := newTargetSource(); err == nil || !strings.Contains(err.Error(), "-privileges.sudo") {
+		t.Errorf("expected -privileges.sudo to be rejected with -ssh.hosts, got %v", err)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
-	"regexp"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,96 +17,375 @@ const (
 	exporterNamespace = "varnish"
 )
 
+// Scrape at most this many targets concurrently
+const maxConcurrentScrapes = 10
+
+var (
+	versionLabelKeys = []string{"major", "minor", "patch", "revision", "version"}
+)
+
 // prometheusExporter
 
 type prometheusExporter struct {
 	sync.RWMutex
 
-	up      prometheus.Gauge
-	version prometheus.Gauge
+	// Parent of all scrape contexts, canceled by Abort
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+
+	source    targetSource
+	targets   map[string]*scrapeTarget // by name, from the previous collect
+	unswept   int                      // ?target= scrapes since the last DescCache sweep
+	up        *prometheus.GaugeVec
+	version   *prometheus.Desc
+	restarts  *restartTracker
+	panics    *panicCapture
+	textfiles *textfileCollector // nil without -textfile.directory
+
+	descCacheEntries   *prometheus.Desc
+	descCacheEvictions *prometheus.Desc
+	labelConflicts     *prometheus.CounterVec
+	labelHistory       *labelConflictHistory
 }
 
 func NewPrometheusExporter() *prometheusExporter {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &prometheusExporter{
-		up: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: exporterNamespace,
-			Name:      "up",
-			Help:      "Was the last scrape of varnish successful.",
-		}),
+		ctx:    ctx,
+		cancel: cancel,
 	}
 }
 
-func (pe *prometheusExporter) Initialize() error {
-	pe.version = prometheus.NewGauge(prometheus.GaugeOpts{
-		Namespace:   exporterNamespace,
-		Name:        "version",
-		Help:        "Varnish version information",
-		ConstLabels: VarnishVersion.Labels(),
-	})
-	pe.version.Set(1)
+// Initialize sets the source of scrape targets. Metrics are
+// labeled with the source label keys from here on.
+func (pe *prometheusExporter) Initialize(source targetSource) error {
+	labelKeys := source.LabelKeys()
+	pe.source = source
+	pe.targets = make(map[string]*scrapeTarget)
+	pe.labelHistory = newLabelConflictHistory()
+	pe.up = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: exporterNamespace,
+		Name:      "up",
+		Help:      "Was the last scrape of varnish successful.",
+	}, labelKeys)
+	pe.version = prometheus.NewDesc(
+		exporterNamespace+"_version",
+		"Varnish version information",
+		append(append([]string{}, versionLabelKeys...), labelKeys...),
+		nil,
+	)
+	pe.restarts = newRestartTracker(labelKeys)
+	pe.panics = newPanicCapture(labelKeys)
+	if StartParams.Textfile.enabled() {
+		pe.textfiles = newTextfileCollector(StartParams.Textfile)
+	}
+	pe.descCacheEntries = prometheus.NewDesc(
+		exporterNamespace+"_exporter_desc_cache_entries",
+		"Number of cached metric descriptors.",
+		nil, nil,
+	)
+	pe.descCacheEvictions = prometheus.NewDesc(
+		exporterNamespace+"_exporter_desc_cache_evictions_total",
+		"Total number of metric descriptors evicted after -desc-cache.max-idle-scrapes scrapes without use.",
+		nil, nil,
+	)
+	pe.labelConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: exporterNamespace,
+		Name:      "exporter_label_conflicts_total",
+		Help:      "Total number of varnishstat counters with conflicting labels, resolved as per -labels.conflict.",
+	}, []string{"reason"})
+	for _, reason := range labelConflictReasons {
+		pe.labelConflicts.WithLabelValues(reason)
+	}
 	return nil
 }
 
+// Abort cancels in-flight scrapes, killing their varnishstat processes,
+// and waits up to timeout for them to return.
+func (pe *prometheusExporter) Abort(timeout time.Duration) {
+	pe.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		pe.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logCollector.Warn("Aborted scrapes did not return in time", "timeout", timeout)
+	}
+}
+
 // Implements prometheus.Collector
 func (pe *prometheusExporter) Describe(ch chan<- *prometheus.Desc) {
 	start := time.Now()
 
-	ch <- pe.up.Desc()
-	if pe.version != nil {
-		ch <- pe.version.Desc()
+	pe.up.Describe(ch)
+	ch <- pe.version
+	pe.restarts.Describe(ch)
+	pe.panics.Describe(ch)
+	ch <- pe.descCacheEntries
+	ch <- pe.descCacheEvictions
+	pe.labelConflicts.Describe(ch)
+	if pe.textfiles != nil {
+		pe.textfiles.Describe(ch)
 	}
 
-	if StartParams.Verbose {
-		logInfo("prometheus.Collector.Describe  %s", time.Now().Sub(start))
-	}
+	logCollector.Debug("prometheus.Collector.Describe", "duration", time.Now().Sub(start))
 }
 
 // Implements prometheus.Collector
 func (pe *prometheusExporter) Collect(ch chan<- prometheus.Metric) {
+	pe.collect(ch, "")
+}
+
+// Scrapes the targets, or only the named target if not empty, and sends the metrics to ch.
+func (pe *prometheusExporter) collect(ch chan<- prometheus.Metric, name string) {
 	start := time.Now()
 
+	pe.inflight.Add(1)
+	defer pe.inflight.Done()
+
+	ctx := withLogAttrs(pe.ctx, "scrape_id", atomic.AddUint64(&scrapeCounter, 1))
+	hadError := ExitHandler.HasError()
+
+	err := pe.scrape(ctx, ch, name)
+	pe.sweepDescCache(ctx, name)
+	ExitHandler.Set(err)
+	if err == nil && hadError {
+		logScrape.InfoContext(ctx, "Successful scrape")
+	}
+
+	if name == "" {
+		pe.up.Collect(ch)
+		pe.restarts.Collect(ch)
+		pe.panics.Collect(ch)
+		// Exporter wide, not reported per target in multi-target mode
+		entries, evictions := DescCache.Stats()
+		ch <- prometheus.MustNewConstMetric(pe.descCacheEntries, prometheus.GaugeValue, float64(entries))
+		ch <- prometheus.MustNewConstMetric(pe.descCacheEvictions, prometheus.CounterValue, float64(evictions))
+		pe.labelConflicts.Collect(ch)
+		if pe.textfiles != nil {
+			pe.textfiles.Collect(ctx, ch)
+		}
+	} else if target := pe.target(name); target != nil {
+		filtered := make(chan prometheus.Metric)
+		done := make(chan struct{})
+		go func() {
+			for m := range filtered {
+				if hasTargetLabels(m, target) {
+					ch <- m
+				}
+			}
+			close(done)
+		}()
+		pe.up.Collect(filtered)
+		pe.restarts.Collect(filtered)
+		pe.panics.Collect(filtered)
+		close(filtered)
+		<-done
+	}
+
+	logCollector.DebugContext(ctx, "prometheus.Collector.Collect", "duration", time.Now().Sub(start), "success", err == nil, "target", name)
+}
+
+// Sweeps DescCache on each scrape of all targets, or once there have been as many ?target=
+// scrapes as targets since the last sweep. Descriptors are shared by the targets, with ?target=
+// scrapes they must not age on each scrape of one target, nor wait for a target never scraped.
+func (pe *prometheusExporter) sweepDescCache(ctx context.Context, name string) {
 	pe.Lock()
 	defer pe.Unlock()
+	if name != "" {
+		if pe.unswept++; pe.unswept < len(pe.targets) {
+			return
+		}
+	}
+	DescCache.Sweep(ctx)
+	pe.unswept = 0
+}
 
-	// Rare case of varnish not being installed in the system
-	// when we started, but installed while we are running.
-	if !VarnishVersion.Valid() {
-		if VarnishVersion.Initialize() == nil {
-			pe.version = prometheus.NewGauge(prometheus.GaugeOpts{
-				Namespace:   exporterNamespace,
-				Name:        "version",
-				Help:        "Varnish version information",
-				ConstLabels: VarnishVersion.Labels(),
-			})
+// TargetCollector returns a collector that scrapes only the named target,
+// for scraping the targets as separate Prometheus jobs in multi-target mode.
+func (pe *prometheusExporter) TargetCollector(name string) prometheus.Collector {
+	return &targetCollector{pe: pe, name: name}
+}
+
+type targetCollector struct {
+	pe   *prometheusExporter
+	name string
+}
+
+// Implements prometheus.Collector
+func (c *targetCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.pe.Describe(ch)
+}
+
+// Implements prometheus.Collector
+func (c *targetCollector) Collect(ch chan<- prometheus.Metric) {
+	c.pe.collect(ch, c.name)
+}
+
+func (pe *prometheusExporter) target(name string) *scrapeTarget {
+	pe.RLock()
+	defer pe.RUnlock()
+	return pe.targets[name]
+}
+
+// HasTarget returns true if the source has a target with name. The targets
+// are resolved again if name is not one of the previously scraped targets.
+func (pe *prometheusExporter) HasTarget(ctx context.Context, name string) bool {
+	if pe.target(name) != nil {
+		return true
+	}
+	pe.Lock()
+	defer pe.Unlock()
+	targets, err := pe.source.Targets(ctx)
+	if err != nil {
+		logScrape.WarnContext(ctx, "Resolving scrape targets failed", "err", err)
+		return false
+	}
+	pe.forgetRemovedTargets(ctx, targets)
+	return pe.targets[name] != nil
+}
+
+// Scrape resolves the targets from the source and scrapes them, sending the
+// varnishstat metrics to ch. Returns the scrape errors of all targets.
+func (pe *prometheusExporter) Scrape(ctx context.Context, ch chan<- prometheus.Metric) error {
+	return pe.scrape(ctx, ch, "")
+}
+
+func (pe *prometheusExporter) scrape(ctx context.Context, ch chan<- prometheus.Metric, name string) error {
+	targets, err := pe.resolveTargets(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// The targets are scraped without the lock, a slow target doesn't hold up ?target= scrapes of the others
+	var (
+		wg      sync.WaitGroup
+		errsMu  sync.Mutex
+		errs    []error
+		limiter = make(chan struct{}, maxConcurrentScrapes)
+		guard   = newLabelGuard(StartParams.LabelConflicts, pe.labelHistory, sendMetrics(ch))
+	)
+	// The metrics of all targets are sent with consistent labels
+	ctx = withLabelGuard(ctx, guard)
+	for _, target := range sortTargets(targets) {
+		wg.Add(1)
+		limiter <- struct{}{}
+		go func(target *scrapeTarget) {
+			defer func() {
+				<-limiter
+				wg.Done()
+			}()
+			if err := pe.scrapeTarget(ctx, target, ch); err != nil {
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+			}
+		}(target)
+	}
+	wg.Wait()
+	guard.Flush(ctx)
+	pe.labelHistory.update(guard, name == "")
+	for reason, count := range guard.Conflicts() {
+		pe.labelConflicts.WithLabelValues(reason).Add(float64(count))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Returns the targets to scrape, all targets of the source or only the named one if not empty.
+func (pe *prometheusExporter) resolveTargets(ctx context.Context, name string) ([]*scrapeTarget, error) {
+	pe.Lock()
+	defer pe.Unlock()
+
+	targets, err := pe.source.Targets(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Resolving scrape targets failed: %s", err)
+	}
+	pe.forgetRemovedTargets(ctx, targets)
+	if name != "" {
+		target := pe.targets[name]
+		if target == nil {
+			return nil, fmt.Errorf("Unknown scrape target %q", name)
 		}
+		targets = []*scrapeTarget{target}
 	}
+	return targets, nil
+}
 
-	hadError := ExitHandler.HasError()
+func (pe *prometheusExporter) scrapeTarget(ctx context.Context, target *scrapeTarget, ch chan<- prometheus.Metric) (err error) {
+	ctx = withLogAttrs(ctx, "instance", target.name)
 
-	_, err := ScrapeVarnish(ch)
-	ExitHandler.Set(err)
+	// A scrape of all targets and a ?target= scrape may overlap
+	target.scrapeMu.Lock()
+	defer target.scrapeMu.Unlock()
 
-	if err == nil {
-		if hadError {
-			logInfo("Successful scrape")
+	// Unexpected varnishstat output must not take the exporter down with it
+	defer func() {
+		if r := recover(); r != nil {
+			logScrape.ErrorContext(ctx, "Scrape panicked", "panic", r, "stack", string(debug.Stack()))
+			pe.up.WithLabelValues(target.labelValues...).Set(0)
+			err = fmt.Errorf("%s: scrape panicked: %v", target.name, r)
 		}
-		pe.up.Set(1)
-	} else {
-		pe.up.Set(0)
+	}()
+
+	// A wedged varnishstat or varnishadm must not hold the scrape until Abort
+	scrapeCtx := ctx
+	if StartParams.ScrapeTimeout > 0 {
+		var cancel context.CancelFunc
+		scrapeCtx, cancel = context.WithTimeout(ctx, StartParams.ScrapeTimeout)
+		defer cancel()
 	}
 
-	ch <- pe.up
-	if pe.version != nil {
-		ch <- pe.version
+	// Rare case of varnish not being installed in the system
+	// when we started, but installed while we are running.
+	if err := target.initializeVersion(scrapeCtx); err != nil {
+		pe.up.WithLabelValues(target.labelValues...).Set(0)
+		return fmt.Errorf("%s: Varnish version initialize failed: %s", target.name, err)
 	}
 
-	if StartParams.Verbose {
-		postfix := ""
-		if err != nil {
-			postfix = " (scrape failed)"
+	tracked := make(map[string]float64)
+	if _, err = ScrapeVarnish(scrapeCtx, target, ch, tracked); err != nil {
+		pe.up.WithLabelValues(target.labelValues...).Set(0)
+		if len(target.labelKeys) > 0 {
+			return fmt.Errorf("%s: %s", target.name, err)
 		}
-		logInfo("prometheus.Collector.Collect   %s%s", time.Now().Sub(start), postfix)
+		return err
 	}
+	pe.up.WithLabelValues(target.labelValues...).Set(1)
+	ch <- prometheus.MustNewConstMetric(pe.version, prometheus.GaugeValue, 1,
+		append(labelValuesFor(versionLabelKeys, target.version.Labels()), target.labelValues...)...)
+
+	pe.restarts.Observe(ctx, target, tracked, time.Now())
+	// Fetches panic.show in the background, past the end of the scrape
+	pe.panics.Observe(ctx, target, tracked)
+	return nil
+}
+
+// Drops the state and series of targets that are no longer returned by the source.
+func (pe *prometheusExporter) forgetRemovedTargets(ctx context.Context, targets []*scrapeTarget) {
+	current := make(map[string]*scrapeTarget, len(targets))
+	for _, target := range targets {
+		current[target.name] = target
+	}
+	for name, target := range pe.targets {
+		if _, ok := current[name]; !ok {
+			logScrape.InfoContext(ctx, "Scrape target removed", "instance", name)
+			pe.up.DeleteLabelValues(target.labelValues...)
+			pe.restarts.Forget(target)
+			pe.panics.Forget(target)
+		}
+	}
+	for name := range current {
+		if _, ok := pe.targets[name]; !ok && len(pe.targets) > 0 {
+			logScrape.InfoContext(ctx, "Scrape target added", "instance", name)
+		}
+	}
+	pe.targets = current
 }
 
 // utils
@@ -129,9 +412,36 @@ var (
 		group{name: "smf", prefixes: []string{
 			"smf.",
 		}},
+		group{name: "smu", prefixes: []string{
+			"smu.",
+		}},
+		// Deprecated persistent stevedore
+		group{name: "smp", prefixes: []string{
+			"smp.",
+		}},
 		group{name: "mgt", prefixes: []string{
 			"mgt.",
 		}},
+		// Varnish Enterprise Massive Storage Engine
+		group{name: "mse", prefixes: []string{
+			"mse.",
+		}},
+		group{name: "mse_store", prefixes: []string{
+			"mse_store.",
+		}},
+		group{name: "mse_book", prefixes: []string{
+			"mse_book.",
+		}},
+		// VMODs
+		group{name: "kvstore", prefixes: []string{
+			"kvstore.",
+		}},
+		group{name: "accg", prefixes: []string{
+			"accg.",
+		}},
+		group{name: "accg_diag", prefixes: []string{
+			"accg_diag.",
+		}},
 		group{name: "main", prefixes: []string{
 			"main.",
 		}},
@@ -195,13 +505,19 @@ var (
 		"varnish_smf_g_smf":       "type",
 		"varnish_smf_g_space":     "type",
 	}
-)
-
-var (
-	// (prefix:)<uuid>.<name>
-	regexBackendUUID = regexp.MustCompile(`([[0-9A-Za-z]{8}-[0-9A-Za-z]{4}-[0-9A-Za-z]{4}-[89ABab][0-9A-Za-z]{3}-[0-9A-Za-z]{12})(.*)`)
-	// <name>(<ip>,(<something>),<port>)
-	regexBackendParen = regexp.MustCompile(`(.*)\((.*)\)`)
+	// Identifier label keys of all metrics in a group, unless set in fqIdentifiers.
+	// Identifiers of more than one part are split on dots, the last key gets the rest.
+	groupIdentifiers = map[string][]string{
+		"sma":       {"type"},
+		"smf":       {"type"},
+		"smu":       {"type"},
+		"smp":       {"type"},
+		"mse":       {"store"},
+		"mse_store": {"store"},
+		"mse_book":  {"book"},
+		"kvstore":   {"kvstore"},
+		"accg":      {"namespace", "key"},
+	}
 )
 
 func findLabelValue(name string, keys, values []string) string {
@@ -243,7 +559,11 @@ func computePrometheusInfo(vName, vGroup, vIdentifier, vDescription string) (nam
 		// as "<group>.<ident>.<name>"
 		if len(vIdentifier) == 0 && strings.Count(vName, ".") > 1 {
 			vIdentifier = prometheusTrimGroupPrefix(strings.ToLower(vName))
-			vIdentifier = vIdentifier[0:strings.LastIndex(vIdentifier, ".")]
+			if dot := strings.LastIndex(vIdentifier, "."); dot != -1 {
+				vIdentifier = vIdentifier[:dot]
+			} else {
+				vIdentifier = ""
+			}
 		}
 	}
 	// name and description
@@ -256,7 +576,8 @@ func computePrometheusInfo(vName, vGroup, vIdentifier, vDescription string) (nam
 		// Make sure our group is prefixed only once
 		fq = prometheusTrimGroupPrefix(fq)
 		// Build fq name
-		name = exporterNamespace + "_" + vGroup + "_" + strings.Replace(fq, ".", "_", -1)
+		// Counter names are not limited to the characters valid in metric names
+		name = sanitizeLabelName(exporterNamespace + "_" + vGroup + "_" + strings.Replace(fq, ".", "_", -1))
 		if swapName := fqNames[name]; len(swapName) > 0 {
 			name = swapName
 		}
@@ -266,18 +587,19 @@ func computePrometheusInfo(vName, vGroup, vIdentifier, vDescription string) (nam
 	{
 		if len(vIdentifier) > 0 {
 			if isVBE := startsWith(vName, "VBE.", caseSensitive); isVBE {
-				if hits := regexBackendUUID.FindAllStringSubmatch(vIdentifier, -1); len(hits) > 0 && len(hits[0]) >= 3 {
-					labelKeys, labelValues = append(labelKeys, "backend"), append(labelValues, cleanBackendName(hits[0][2]))
-					labelKeys, labelValues = append(labelKeys, "server"), append(labelValues, hits[0][1])
-				} else if hits := regexBackendParen.FindAllStringSubmatch(vIdentifier, -1); len(hits) > 0 && len(hits[0]) >= 3 {
-					labelKeys, labelValues = append(labelKeys, "backend"), append(labelValues, cleanBackendName(hits[0][1]))
-					labelKeys, labelValues = append(labelKeys, "server"), append(labelValues, strings.Replace(hits[0][2], ",,", ":", 1))
-				}
 				// We must be consistent with the number of labels and their names inside this scrape and between scrapes, or we will get this error:
 				// https://github.com/prometheus/client_golang/blob/3fb8ace93bc4ccddea55af62320c2fd109252880/prometheus/registry.go#L704-L707
-				if len(labelKeys) == 0 {
-					labelKeys, labelValues = append(labelKeys, "backend"), append(labelValues, cleanBackendName(vIdentifier))
-					labelKeys, labelValues = append(labelKeys, "server"), append(labelValues, "unknown")
+				// labelGuard resolves the conflicts that get through
+				labelKeys, labelValues = append(labelKeys, BackendNames.labelKeys...), append(labelValues, BackendNames.parse(vIdentifier)...)
+			}
+			if keys := groupIdentifiers[vGroup]; len(labelKeys) == 0 && len(fqIdentifiers[name]) == 0 && len(keys) > 0 {
+				parts := strings.SplitN(vIdentifier, ".", len(keys))
+				for i, key := range keys {
+					value := ""
+					if i < len(parts) {
+						value = parts[i]
+					}
+					labelKeys, labelValues = append(labelKeys, key), append(labelValues, value)
 				}
 			}
 			if len(labelKeys) == 0 {
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	restartReasonPanic  = "panic"
+	restartReasonDied   = "died"
+	restartReasonManual = "manual"
+)
+
+var restartReasons = []string{restartReasonPanic, restartReasonDied, restartReasonManual}
+
+var (
+	// Varnish counters the restartTracker needs to see on each scrape.
+	// Varnish 3.x reports MAIN counters without the group prefix, see trackedCounterName.
+	restartCounters = []string{
+		"MAIN.uptime",
+		"MGT.uptime",
+		"MGT.child_start",
+		"MGT.child_died",
+		"MGT.child_panic",
+	}
+)
+
+// Returns the restartCounters name for vName, empty if vName is not tracked.
+func trackedCounterName(vName string) string {
+	if vName == "uptime" {
+		vName = "MAIN.uptime"
+	}
+	for _, name := range restartCounters {
+		if name == vName {
+			return name
+		}
+	}
+	return ""
+}
+
+// restartTracker detects varnishd child restarts by comparing
+// uptime and child process counters between scrapes of a target.
+type restartTracker struct {
+	sync.Mutex
+
+	previous map[string]map[string]float64 // by target name
+
+	restarts    *prometheus.CounterVec
+	lastRestart *prometheus.GaugeVec
+}
+
+// The metrics are labeled with labelKeys, see targetSource.
+func newRestartTracker(labelKeys []string) *restartTracker {
+	return &restartTracker{
+		previous: make(map[string]map[string]float64),
+		restarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: exporterNamespace,
+			Name:      "child_restarts_observed_total",
+			Help:      "Number of varnishd child restarts observed by the exporter between scrapes.",
+		}, append([]string{"reason"}, labelKeys...)),
+		lastRestart: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: exporterNamespace,
+			Name:      "last_restart_timestamp_seconds",
+			Help:      "Unix timestamp of the last observed varnishd child restart.",
+		}, labelKeys),
+	}
+}
+
+// Observe compares the tracked counters of a successful scrape to the previous one of target.
+// Returns the restart reason if a restart was detected, otherwise an empty string.
+func (rt *restartTracker) Observe(ctx context.Context, target *scrapeTarget, counters map[string]float64, now time.Time) string {
+	rt.Lock()
+	defer rt.Unlock()
+
+	previous := rt.previous[target.name]
+	rt.previous[target.name] = counters
+	if previous == nil {
+		// Every reason from the first scrape on, for rate() and increase() to see the first restart
+		for _, reason := range restartReasons {
+			rt.restarts.WithLabelValues(append([]string{reason}, target.labelValues...)...)
+		}
+		return ""
+	}
+
+	reason := detectRestart(previous, counters)
+	if reason == "" {
+		return ""
+	}
+
+	restartedAt := now
+	if uptime, ok := counters["MAIN.uptime"]; ok {
+		restartedAt = now.Add(-time.Duration(uptime) * time.Second)
+	}
+	rt.restarts.WithLabelValues(append([]string{reason}, target.labelValues...)...).Inc()
+	rt.lastRestart.WithLabelValues(target.labelValues...).Set(float64(restartedAt.Unix()))
+
+	logRestart.WarnContext(ctx, "Varnish child restart detected",
+		"reason", reason,
+		"uptime", counterChange(previous, counters, "MAIN.uptime"),
+		"child_start", counterChange(previous, counters, "MGT.child_start"),
+		"child_died", counterChange(previous, counters, "MGT.child_died"),
+		"child_panic", counterChange(previous, counters, "MGT.child_panic"),
+	)
+	return reason
+}
+
+// Forget drops the state and series of a removed target.
+func (rt *restartTracker) Forget(target *scrapeTarget) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	delete(rt.previous, target.name)
+	for _, reason := range restartReasons {
+		rt.restarts.DeleteLabelValues(append([]string{reason}, target.labelValues...)...)
+	}
+	rt.lastRestart.DeleteLabelValues(target.labelValues...)
+}
+
+func (rt *restartTracker) Describe(ch chan<- *prometheus.Desc) {
+	rt.restarts.Describe(ch)
+	rt.lastRestart.Describe(ch)
+}
+
+func (rt *restartTracker) Collect(ch chan<- prometheus.Metric) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	rt.restarts.Collect(ch)
+	rt.lastRestart.Collect(ch)
+}
+
+// Returns the restart reason if the counters indicate a restart between the two scrapes.
+func detectRestart(previous, current map[string]float64) string {
+	// The whole varnishd was restarted, MGT counters are reset and cannot be compared.
+	if decreased(previous, current, "MGT.uptime") {
+		return restartReasonManual
+	}
+	if increased(previous, current, "MGT.child_panic") {
+		return restartReasonPanic
+	}
+	if increased(previous, current, "MGT.child_died") {
+		return restartReasonDied
+	}
+	// Child stopped and started via varnishadm or the child uptime reset
+	// without the management process telling us why (Varnish 3.x).
+	if increased(previous, current, "MGT.child_start") || decreased(previous, current, "MAIN.uptime") {
+		return restartReasonManual
+	}
+	return ""
+}
+
+func increased(previous, current map[string]float64, name string) bool {
+	p, okP := previous[name]
+	c, okC := current[name]
+	return okP && okC && c > p
+}
+
+func decreased(previous, current map[string]float64, name string) bool {
+	p, okP := previous[name]
+	c, okC := current[name]
+	return okP && okC && c < p
+}
+
+// Returns "<previous>-><current>" for logging, "-" for missing values.
+func counterChange(previous, current map[string]float64, name string) string {
+	format := func(counters map[string]float64) string {
+		if value, ok := counters[name]; ok {
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+		return "-"
+	}
+	return format(previous) + "->" + format(current)
+}
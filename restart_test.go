@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_DetectRestart(t *testing.T) {
+	type testConfig struct {
+		name     string
+		previous map[string]float64
+		current  map[string]float64
+		expected string
+	}
+
+	running := map[string]float64{
+		"MAIN.uptime": 1000, "MGT.uptime": 1010, "MGT.child_start": 1, "MGT.child_died": 0, "MGT.child_panic": 0,
+	}
+	for _, testConfig := range []testConfig{
+		{"no restart", running, map[string]float64{
+			"MAIN.uptime": 1015, "MGT.uptime": 1025, "MGT.child_start": 1, "MGT.child_died": 0, "MGT.child_panic": 0,
+		}, ""},
+		{"panic", running, map[string]float64{
+			"MAIN.uptime": 3, "MGT.uptime": 1025, "MGT.child_start": 2, "MGT.child_died": 1, "MGT.child_panic": 1,
+		}, restartReasonPanic},
+		{"died", running, map[string]float64{
+			"MAIN.uptime": 3, "MGT.uptime": 1025, "MGT.child_start": 2, "MGT.child_died": 1, "MGT.child_panic": 0,
+		}, restartReasonDied},
+		{"varnishadm stop/start", running, map[string]float64{
+			"MAIN.uptime": 3, "MGT.uptime": 1025, "MGT.child_start": 2, "MGT.child_died": 0, "MGT.child_panic": 0,
+		}, restartReasonManual},
+		{"varnishd restart", running, map[string]float64{
+			"MAIN.uptime": 3, "MGT.uptime": 4, "MGT.child_start": 1, "MGT.child_died": 0, "MGT.child_panic": 0,
+		}, restartReasonManual},
+		{"varnish 3.x", map[string]float64{"MAIN.uptime": 1000}, map[string]float64{"MAIN.uptime": 3}, restartReasonManual},
+		{"counters missing", running, map[string]float64{}, ""},
+	} {
+		computed := detectRestart(testConfig.previous, testConfig.current)
+		t.Logf("%s\n", testConfig.name)
+		t.Logf("  expected reason : %q\n", testConfig.expected)
+		t.Logf("  computed reason : %q\n", computed)
+
+		if computed != testConfig.expected {
+			t.Fatalf("%s: reason %q != %q", testConfig.name, computed, testConfig.expected)
+		}
+	}
+}
+
+func Test_RestartTrackerObserve(t *testing.T) {
+	rt := newRestartTracker(nil)
+	now := time.Unix(1600000000, 0)
+
+	if reason := rt.Observe(context.Background(), testTarget, map[string]float64{"MAIN.uptime": 100, "MGT.child_panic": 0}, now); reason != "" {
+		t.Fatalf("first scrape cannot detect a restart, got %q", reason)
+	}
+
+	// All reasons are 0 before the first restart
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(rt)
+	gathering, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]float64)
+	for _, mf := range gathering {
+		if mf.GetName() != "varnish_child_restarts_observed_total" {
+			continue
+		}
+		for _, m := range mf.Metric {
+			reasons[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	for _, reason := range restartReasons {
+		if value, ok := reasons[reason]; !ok || value != 0 {
+			t.Errorf("%s: expected 0 after the first scrape, got %v", reason, reasons)
+		}
+	}
+
+	if reason := rt.Observe(context.Background(), testTarget, map[string]float64{"MAIN.uptime": 10, "MGT.child_panic": 1}, now); reason != restartReasonPanic {
+		t.Fatalf("reason %q != %q", reason, restartReasonPanic)
+	}
+	if reason := rt.Observe(context.Background(), testTarget, map[string]float64{"MAIN.uptime": 25, "MGT.child_panic": 1}, now); reason != "" {
+		t.Fatalf("unexpected restart %q", reason)
+	}
+
+	gathering, err = registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, mf := range gathering {
+		for _, m := range mf.Metric {
+			if m.Counter != nil {
+				values[mf.GetName()] += m.Counter.GetValue()
+			} else if m.Gauge != nil {
+				values[mf.GetName()] = m.Gauge.GetValue()
+			}
+		}
+	}
+	if values["varnish_child_restarts_observed_total"] != 1 {
+		t.Errorf("varnish_child_restarts_observed_total %v != 1", values["varnish_child_restarts_observed_total"])
+	}
+	if expected := float64(now.Unix() - 10); values["varnish_last_restart_timestamp_seconds"] != expected {
+		t.Errorf("varnish_last_restart_timestamp_seconds %v != %v", values["varnish_last_restart_timestamp_seconds"], expected)
+	}
+}
+
+func Test_ScrapeTrackedCounters(t *testing.T) {
+	dir, _ := os.Getwd()
+	if !fileExists(filepath.Join(dir, "test/scrape")) {
+		t.Skipf("Cannot find test/scrape files from workind dir %s", dir)
+	}
+	for version, expected := range map[string][]string{
+		"3.0.5": {"MAIN.uptime"},
+		"6.5.1": restartCounters,
+	} {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape", version+".json"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		VarnishVersion.parseVersion(version)
+
+		done := make(chan bool)
+		metrics := make(chan prometheus.Metric)
+		go func() {
+			for range metrics {
+			}
+			done <- true
+		}()
+		tracked := make(map[string]float64)
+		_, err = ScrapeVarnishFrom(context.Background(), testTarget, buf, metrics, tracked)
+		close(metrics)
+		<-done
+
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		for _, name := range expected {
+			if _, ok := tracked[name]; !ok {
+				t.Errorf("%s: tracked counter %s not found", version, name)
+			}
+		}
+	}
+}
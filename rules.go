@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Prometheus rule file, see https://prometheus.io/docs/prometheus/latest/configuration/recording_rules/
+type ruleGroups struct {
+	Groups []*ruleGroup `yaml:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string  `yaml:"name"`
+	Rules []*rule `yaml:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// Labels of a backend server, aggregated away by the per backend recording rules
+var backendServerLabelKeys = []string{"server", "host", "port", "vcl"}
+
+// Backend gauges without a meaningful sum over servers: the happy probe bitmap,
+// and up where a sum hides the down servers
+var backendUnsummable = map[string]bool{
+	"varnish_backend_happy": true,
+	"varnish_backend_up":    true,
+}
+
+// Prints Prometheus recording and alerting rules for the metrics exported from varnishstat
+// or a varnishstat -j output file. Returns the exit code.
+func rulesCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("rules", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	file := fs.String("file", "", "varnishstat -j output file to read instead of running varnishstat.")
+	varnishFlags(fs)
+	logFlags(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s rules [flags]\n\nPrints Prometheus recording and alerting rules for the metrics varnishstat counters are exported as.\n\n", ApplicationName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if err := LogConfig.Initialize(stderr, StartParams.Raw); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if err := applyVarnishFlags(); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	shapes, err := metricShapes(context.Background(), *file)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	// Long expressions are not wrapped for readability
+	yaml.FutureLineWrap()
+	buf, err := yaml.Marshal(varnishRules(shapes))
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	source := "varnishstat"
+	if *file != "" {
+		source = *file
+	}
+	fmt.Fprintf(stdout, "# Generated by %s rules from %s\n", ApplicationName, source)
+	if _, err := stdout.Write(buf); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Returns the rules for the metrics, rules of metrics not exported are left out.
+func varnishRules(shapes []*metricShape) *ruleGroups {
+	byName := make(map[string]*metricShape)
+	for _, shape := range shapes {
+		byName[shape.name] = shape
+	}
+
+	// Backend metrics summed over the servers of each backend, the rate of counters so
+	// that the reset of a single server counter doesn't reset the sum
+	recording := &ruleGroup{Name: "varnish"}
+	for _, shape := range shapes {
+		if !strings.HasPrefix(shape.name, "varnish_backend_") || backendUnsummable[shape.name] {
+			continue
+		}
+		var without []string
+		for _, key := range backendServerLabelKeys {
+			if indexOf(shape.labels, key) != -1 {
+				without = append(without, key)
+			}
+		}
+		if len(without) == 0 {
+			continue
+		}
+		switch shape.typ {
+		case "counter":
+			recording.Rules = append(recording.Rules, &rule{
+				Record: "backend:" + shape.name + ":rate5m",
+				Expr:   fmt.Sprintf("sum without (%s) (rate(%s[5m]))", strings.Join(without, ", "), shape.name),
+			})
+		case "gauge":
+			recording.Rules = append(recording.Rules, &rule{
+				Record: "backend:" + shape.name + ":sum",
+				Expr:   fmt.Sprintf("sum without (%s) (%s)", strings.Join(without, ", "), shape.name),
+			})
+		}
+	}
+	// Hit ratio as calculated by varnishstat, of each scraped varnishd with all its labels
+	if byName["varnish_main_cache_hit"] != nil && byName["varnish_main_cache_miss"] != nil {
+		recording.Rules = append(recording.Rules, &rule{
+			Record: "varnish:varnish_main_cache_hit_ratio:rate5m",
+			Expr:   "rate(varnish_main_cache_hit[5m]) / (rate(varnish_main_cache_hit[5m]) + rate(varnish_main_cache_miss[5m]))",
+		})
+	}
+
+	alerting := &ruleGroup{Name: "varnish-alerts"}
+	if byName["varnish_backend_up"] != nil {
+		alerting.Rules = append(alerting.Rules, &rule{
+			Alert:  "VarnishBackendDown",
+			Expr:   "varnish_backend_up == 0",
+			For:    "2m",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "Varnish backend {{ $labels.backend }} is down",
+				"description": "Health probes of backend {{ $labels.backend }} server {{ $labels.server }} on {{ $labels.instance }} are failing.",
+			},
+		})
+	}
+	if byName["varnish_main_thread_queue_len"] != nil {
+		alerting.Rules = append(alerting.Rules, &rule{
+			Alert:  "VarnishThreadQueueGrowing",
+			Expr:   "varnish_main_thread_queue_len > 0 and deriv(varnish_main_thread_queue_len[5m]) > 0",
+			For:    "5m",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Varnish sessions are queued waiting for a worker thread",
+				"description": "{{ $value }} sessions are queued on {{ $labels.instance }} and the queue is growing, the thread pools may be too small.",
+			},
+		})
+	}
+	var failures []string
+	for _, name := range []string{"varnish_sma_c_fail", "varnish_smf_c_fail", "varnish_smu_c_fail", "varnish_smp_c_fail", "varnish_mse_c_fail"} {
+		if byName[name] != nil {
+			failures = append(failures, fmt.Sprintf("increase(%s[5m]) > 0", name))
+		}
+	}
+	if len(failures) > 0 {
+		alerting.Rules = append(alerting.Rules, &rule{
+			Alert:  "VarnishStorageAllocationFailures",
+			Expr:   strings.Join(failures, " or "),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary":     "Varnish storage allocations are failing",
+				"description": "Allocations in storage {{ $labels.type }}{{ $labels.store }} on {{ $labels.instance }} failed, objects are evicted or not cached.",
+			},
+		})
+	}
+	if byName["varnish_mgt_child_panic"] != nil {
+		alerting.Rules = append(alerting.Rules, &rule{
+			Alert:  "VarnishChildPanic",
+			Expr:   "increase(varnish_mgt_child_panic[15m]) > 0",
+			Labels: map[string]string{"severity": "critical"},
+			Annotations: map[string]string{
+				"summary":     "Varnish child process panicked",
+				"description": "The varnishd child on {{ $labels.instance }} panicked and was restarted, the cache is empty. See varnishadm panic.show.",
+			},
+		})
+	}
+
+	rules := &ruleGroups{}
+	for _, group := range []*ruleGroup{recording, alerting} {
+		if len(group.Rules) > 0 {
+			rules.Groups = append(rules.Groups, group)
+		}
+	}
+	return rules
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// The fields of the rule file format used by the generated rules.
+type testRuleGroups struct {
+	Groups []struct {
+		Name     string `yaml:"name"`
+		Interval string `yaml:"interval"`
+		Rules    []struct {
+			Record      string            `yaml:"record"`
+			Alert       string            `yaml:"alert"`
+			Expr        string            `yaml:"expr"`
+			For         string            `yaml:"for"`
+			Labels      map[string]string `yaml:"labels"`
+			Annotations map[string]string `yaml:"annotations"`
+		} `yaml:"rules"`
+	} `yaml:"groups"`
+}
+
+var regexRuleMetricName = regexp.MustCompile(`\bvarnish_[a-zA-Z0-9_]+`)
+
+// Returns the problems found in the structure of the rule file, its durations, names and
+// templates, and the metrics referenced by the expressions that are not in exported. The
+// expressions are not parsed, only their brackets counted. Test_Rules runs promtool check
+// rules for the PromQL, it is required when CI is set.
+func validateRules(buf []byte, exported map[string]bool) []string {
+	var rules testRuleGroups
+	if err := yaml.UnmarshalStrict(buf, &rules); err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	groups := make(map[string]bool)
+	for _, group := range rules.Groups {
+		if group.Name == "" || groups[group.Name] {
+			problems = append(problems, "empty or repeated group name "+group.Name)
+		}
+		groups[group.Name] = true
+		if len(group.Rules) == 0 {
+			problems = append(problems, group.Name+": no rules")
+		}
+		for _, rule := range group.Rules {
+			name := rule.Record + rule.Alert
+			switch {
+			case (rule.Record == "") == (rule.Alert == ""):
+				problems = append(problems, name+": one of record or alert must be set")
+			case rule.Record != "" && !model.IsValidMetricName(model.LabelValue(rule.Record)):
+				problems = append(problems, name+": invalid recording rule name")
+			case rule.Record != "" && (rule.For != "" || len(rule.Annotations) > 0):
+				problems = append(problems, name+": for and annotations are only valid in alerting rules")
+			}
+			if rule.For != "" {
+				if _, err := model.ParseDuration(rule.For); err != nil {
+					problems = append(problems, name+": "+err.Error())
+				}
+			}
+			if strings.Count(rule.Expr, "(") != strings.Count(rule.Expr, ")") || strings.Count(rule.Expr, "[") != strings.Count(rule.Expr, "]") {
+				problems = append(problems, name+": unbalanced expression "+rule.Expr)
+			}
+			for _, metric := range regexRuleMetricName.FindAllString(rule.Expr, -1) {
+				if !exported[metric] {
+					problems = append(problems, name+": "+metric+" is not exported")
+				}
+			}
+			for _, labels := range []map[string]string{rule.Labels, rule.Annotations} {
+				for key, value := range labels {
+					if !model.LabelName(key).IsValid() {
+						problems = append(problems, name+": invalid label name "+key)
+					}
+					data := "{{ $labels := .Labels }}{{ $value := .Value }}"
+					if _, err := template.New(key).Option("missingkey=zero").Parse(data + value); err != nil {
+						problems = append(problems, name+": "+err.Error())
+					}
+				}
+			}
+		}
+	}
+	return problems
+}
+
+func Test_Rules(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixtures, _ := filepath.Glob(filepath.Join(dir, "test/scrape/*.json"))
+	if len(fixtures) == 0 {
+		t.Skipf("Cannot find test/scrape files from working dir %s", dir)
+	}
+	t.Cleanup(func() {
+		StartParams.VCLLabel = false
+		LogConfig.Initialize(os.Stdout, false)
+	})
+	promtool, _ := exec.LookPath("promtool")
+	if promtool == "" && os.Getenv("CI") != "" {
+		t.Fatal("promtool is required in CI to check the PromQL of the rules")
+	}
+
+	for _, fixture := range fixtures {
+		version := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		shapes, err := metricShapes(context.Background(), fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exported := make(map[string]bool)
+		for _, shape := range shapes {
+			exported[shape.name] = true
+		}
+
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		if code := rulesCommand([]string{"-file", fixture}, stdout, stderr); code != 0 {
+			t.Fatalf("%s: exit %d: %s", version, code, stderr)
+		}
+		if problems := validateRules(stdout.Bytes(), exported); len(problems) > 0 {
+			t.Errorf("%s:\n%s\n%s", version, strings.Join(problems, "\n"), stdout)
+		}
+		out := stdout.String()
+		t.Logf("%s: %d bytes, %d rules", version, len(out), strings.Count(out, "expr: "))
+
+		// Only the alerts of the exported metrics
+		for alert, metric := range map[string]string{
+			"VarnishBackendDown":        "varnish_backend_up",
+			"VarnishThreadQueueGrowing": "varnish_main_thread_queue_len",
+			"VarnishChildPanic":         "varnish_mgt_child_panic",
+		} {
+			if strings.Contains(out, "alert: "+alert+"\n") != exported[metric] {
+				t.Errorf("%s: expected alert %s only with %s", version, alert, metric)
+			}
+		}
+
+		if promtool != "" {
+			path := filepath.Join(t.TempDir(), version+".yml")
+			if err := ioutil.WriteFile(path, stdout.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if out, err := exec.Command(promtool, "check", "rules", path).CombinedOutput(); err != nil {
+				t.Errorf("%s: promtool check rules: %s\n%s", version, err, out)
+			}
+		}
+	}
+
+	// The vcl label is aggregated away with the servers
+	fixture := filepath.Join(dir, "test/scrape/synthetic-7.6.1.json")
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := rulesCommand([]string{"-file", fixture, "-vcl.label"}, stdout, stderr); code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+	for _, expected := range []string{
+		"record: backend:varnish_backend_req:rate5m\n    expr: sum without (server, vcl) (rate(varnish_backend_req[5m]))\n",
+		"record: backend:varnish_backend_conn:sum\n    expr: sum without (server, vcl) (varnish_backend_conn)\n",
+	} {
+		if !strings.Contains(stdout.String(), expected) {
+			t.Errorf("expected %q in\n%s", expected, stdout)
+		}
+	}
+	// Not summed over servers
+	for _, name := range []string{"varnish_backend_happy", "varnish_backend_up"} {
+		if strings.Contains(stdout.String(), "backend:"+name+":") {
+			t.Errorf("unexpected recording rule of %s in\n%s", name, stdout)
+		}
+	}
+
+	// Invalid rules are caught
+	for _, invalid := range []string{
+		"groups:\n- name: a\n  rules:\n  - record: a b\n    expr: varnish_main_uptime\n",
+		"groups:\n- name: a\n  rules:\n  - alert: A\n    record: a\n    expr: varnish_main_uptime\n",
+		"groups:\n- name: a\n  rules:\n  - alert: A\n    expr: rate(varnish_main_uptime[5m]\n",
+		"groups:\n- name: a\n  rules:\n  - alert: A\n    expr: varnish_main_missing\n",
+		"groups:\n- name: a\n  rules:\n  - alert: A\n    expr: varnish_main_uptime\n    for: 5 minutes\n",
+		"groups:\n- name: a\n  rules:\n  - alert: A\n    expr: varnish_main_uptime\n    annotations:\n      summary: '{{ $labels.instance '\n",
+		"groups:\n- name: a\n  rules:\n  - alert: A\n    expression: varnish_main_uptime\n",
+	} {
+		if problems := validateRules([]byte(invalid), map[string]bool{"varnish_main_uptime": true}); len(problems) == 0 {
+			t.Errorf("expected problems in\n%s", invalid)
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type sshParams struct {
+	Hosts      string
+	User       string
+	KeyFile    string
+	KnownHosts string
+	Timeout    time.Duration
+}
+
+func (p *sshParams) enabled() bool {
+	return p.Hosts != ""
+}
+
+// sshSource runs varnishstat on remote hosts over SSH, each host is a target.
+// Connections are kept open between scrapes, each command runs in its own session.
+type sshSource struct {
+	pool      *sshPool
+	labelKeys []string
+	targets   []*scrapeTarget
+}
+
+func newSSHSource(params *sshParams) (*sshSource, error) {
+	config, err := params.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	s := &sshSource{
+		pool:      newSSHPool(config),
+		labelKeys: []string{"host"},
+	}
+	seen := make(map[string]bool)
+	for _, host := range strings.Split(params.Hosts, ",") {
+		if host = strings.TrimSpace(host); host == "" {
+			continue
+		}
+		username, address := config.User, host
+		if at := strings.LastIndex(host, "@"); at != -1 {
+			username, address = host[:at], host[at+1:]
+		}
+		if address == "" {
+			return nil, fmt.Errorf("-ssh.hosts: invalid host %q", host)
+		}
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			address = net.JoinHostPort(address, "22")
+		}
+		if seen[address] {
+			return nil, fmt.Errorf("-ssh.hosts: duplicate host %q", host)
+		}
+		seen[address] = true
+
+		name := strings.TrimSuffix(host[strings.LastIndex(host, "@")+1:], ":22")
+		exec := func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+			return s.pool.run(ctx, username, address, shellCommand(exe, params...))
+		}
+		s.targets = append(s.targets, newScrapeTarget(name, s.labelKeys, []string{name}, exec))
+	}
+	return s, nil
+}
+
+func (s *sshSource) LabelKeys() []string {
+	return s.labelKeys
+}
+
+func (s *sshSource) Targets(ctx context.Context) ([]*scrapeTarget, error) {
+	return s.targets, nil
+}
+
+// Returns the client config with key authentication and known_hosts host key verification.
+func (p *sshParams) clientConfig() (*ssh.ClientConfig, error) {
+	home, _ := os.UserHomeDir()
+	username := p.User
+	if username == "" {
+		if current, err := user.Current(); err == nil {
+			username = current.Username
+		}
+	}
+
+	keyFiles := []string{p.KeyFile}
+	if p.KeyFile == "" {
+		keyFiles = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if path := filepath.Join(home, ".ssh", name); fileExists(path) {
+				keyFiles = append(keyFiles, path)
+			}
+		}
+		if len(keyFiles) == 0 {
+			return nil, fmt.Errorf("-ssh.key-file not set and no key found in %s", filepath.Join(home, ".ssh"))
+		}
+	}
+	var signers []ssh.Signer
+	for _, keyFile := range keyFiles {
+		pem, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("-ssh.key-file: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("-ssh.key-file: %s: %s", keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	knownHostsFile := p.KnownHosts
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("-ssh.known-hosts: %s", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         p.Timeout,
+	}, nil
+}
+
+// sshPool keeps a connection open to each host. Broken connections are dropped
+// and dialed again on the next command.
+type sshPool struct {
+	sync.Mutex
+
+	config *ssh.ClientConfig
+	hosts  map[string]*sshHost // by user@address
+}
+
+// sshHost is the pooled connection to a host. Its lock is held while dialing,
+// so a slow or unreachable host only delays the commands to itself.
+type sshHost struct {
+	sync.Mutex
+
+	client *ssh.Client
+}
+
+func newSSHPool(config *ssh.ClientConfig) *sshPool {
+	return &sshPool{
+		config: config,
+		hosts:  make(map[string]*sshHost),
+	}
+}
+
+func (p *sshPool) host(username, address string) *sshHost {
+	key := username + "@" + address
+	p.Lock()
+	defer p.Unlock()
+	host := p.hosts[key]
+	if host == nil {
+		host = &sshHost{}
+		p.hosts[key] = host
+	}
+	return host
+}
+
+func (p *sshPool) client(ctx context.Context, username, address string) (*ssh.Client, error) {
+	host := p.host(username, address)
+	host.Lock()
+	defer host.Unlock()
+	if host.client != nil {
+		return host.client, nil
+	}
+
+	dialer := net.Dialer{Timeout: p.config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake does not take a context
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else if p.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(p.config.Timeout))
+	}
+	config := *p.config
+	config.User = username
+	c, chans, reqs, err := ssh.NewClientConn(conn, address, &config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	host.client = ssh.NewClient(c, chans, reqs)
+	return host.client, nil
+}
+
+// Drops client if it is still the pooled connection for the host.
+func (p *sshPool) drop(username, address string, client *ssh.Client) {
+	host := p.host(username, address)
+	host.Lock()
+	defer host.Unlock()
+	if host.client == client {
+		host.client = nil
+	}
+	client.Close()
+}
+
+// Runs command on the host. Returns stdout on success, stderr and stdout on failure.
+// The remote process is killed if ctx is done before it exits.
+func (p *sshPool) run(ctx context.Context, username, address, command string) (*bytes.Buffer, error) {
+	var client *ssh.Client
+	var session *ssh.Session
+	// Retry once with a new connection if the pooled one was closed by the server
+	for attempt := 0; session == nil; attempt++ {
+		var err error
+		client, err = p.client(ctx, username, address)
+		if err != nil {
+			return &bytes.Buffer{}, fmt.Errorf("ssh to %s failed: %s", address, err)
+		}
+		session, err = client.NewSession()
+		if err != nil {
+			p.drop(username, address, client)
+			if attempt > 0 {
+				return &bytes.Buffer{}, fmt.Errorf("ssh to %s failed: %s", address, err)
+			}
+		}
+	}
+	defer session.Close()
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	session.Stdout, session.Stderr = stdout, stderr
+	if err := session.Start(command); err != nil {
+		return stderr, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		// The output is written until Wait returns, once the server closes the session too
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			p.drop(username, address, client)
+			<-done
+		}
+		err = ctx.Err()
+	}
+	if err != nil {
+		stderr.Write(stdout.Bytes())
+		return stderr, err
+	}
+	return stdout, nil
+}
+
+// Returns the command line for a remote shell, quoting arguments as needed.
+func shellCommand(exe string, params ...string) string {
+	args := make([]string, 0, len(params)+1)
+	for _, arg := range append([]string{exe}, params...) {
+		if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=,@") == "" {
+			args = append(args, arg)
+		} else {
+			args = append(args, "'"+strings.Replace(arg, "'", `'\''`, -1)+"'")
+		}
+	}
+	return strings.Join(args, " ")
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// In-process SSH server running fake varnish tools. Returns the listen address
+// and the number of connections accepted so far.
+func newFakeSSHServer(t *testing.T, hostKey ssh.Signer, clientKey ssh.PublicKey, stats []byte) (string, *int32) {
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "varnish" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, ssh.ErrNoAuth
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			go func() {
+				_, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				for newChannel := range chans {
+					if newChannel.ChannelType() != "session" {
+						newChannel.Reject(ssh.UnknownChannelType, "")
+						continue
+					}
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						continue
+					}
+					go serveFakeSSHSession(channel, requests, stats)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), &connections
+}
+
+func serveFakeSSHSession(channel ssh.Channel, requests <-chan *ssh.Request, stats []byte) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+		// string command, length prefixed
+		command := string(req.Payload[4:])
+		status := uint32(0)
+		switch {
+		case command == "varnishstat -V":
+			channel.Write([]byte("varnishstat (varnish-6.5.1 revision 1dae23376bb5ea7a6b8e9e4b9ed95cdc9469fb64)\n"))
+		case strings.HasPrefix(command, "varnishstat -j"):
+			channel.Write(stats)
+		case command == "hang":
+			// Partial output, then no exit until the client closes the session
+			channel.Write([]byte("partial"))
+			for range requests {
+			}
+			return
+		default:
+			channel.Stderr().Write([]byte("command not found: " + command + "\n"))
+			status = 127
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, status)
+		channel.SendRequest("exit-status", false, payload)
+		return
+	}
+}
+
+func Test_SSHSource(t *testing.T) {
+	dir, _ := os.Getwd()
+	stats, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape/6.5.1.json"))
+	if err != nil {
+		t.Skipf("Cannot read test file: %s", err)
+	}
+	tmp := t.TempDir()
+
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	clientKey, err := ssh.NewSignerFromKey(clientPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPrivate, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(tmp, "id_ed25519")
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(block)))
+
+	address, connections := newFakeSSHServer(t, hostKey, clientKey.PublicKey(), stats)
+	// Same server under two names, only the first one is known
+	_, port, _ := net.SplitHostPort(address)
+	unknown := net.JoinHostPort("localhost", port)
+	knownHostsFile := filepath.Join(tmp, "known_hosts")
+	writeTestFile(t, knownHostsFile, knownhosts.Line([]string{address}, hostKey.PublicKey())+"\n")
+
+	source, err := newSSHSource(&sshParams{
+		Hosts:      "varnish@" + address + ", varnish@" + unknown,
+		KeyFile:    keyFile,
+		KnownHosts: knownHostsFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter := NewPrometheusExporter()
+	if err := exporter.Initialize(source); err != nil {
+		t.Fatal(err)
+	}
+	previous := PrometheusExporter
+	PrometheusExporter = exporter
+	defer func() { PrometheusExporter = previous }()
+
+	handler := targetHandler(http.NotFoundHandler())
+	get := func(query string) (int, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics?"+query, nil))
+		return w.Code, w.Body.String()
+	}
+
+	for i := 0; i < 3; i++ {
+		code, body := get("target=" + address)
+		if code != http.StatusOK {
+			t.Fatalf("status %d: %s", code, body)
+		}
+		if !strings.Contains(body, `varnish_up{host="`+address+`"} 1`) || !strings.Contains(body, `varnish_backend_happy{`) {
+			t.Fatalf("unexpected metrics:\n%s", body)
+		}
+		if strings.Contains(body, unknown) {
+			t.Errorf("other target in target metrics:\n%s", body)
+		}
+	}
+	// The connection is reused between scrapes
+	if n := atomic.LoadInt32(connections); n != 1 {
+		t.Errorf("expected 1 pooled connection, got %d", n)
+	}
+
+	// Host key of the unknown host is not accepted
+	code, body := get("target=" + unknown)
+	if code != http.StatusOK || !strings.Contains(body, `varnish_up{host="`+unknown+`"} 0`) {
+		t.Errorf("unknown host was scraped, status %d:\n%s", code, body)
+	}
+	if code, _ := get("target=nope"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown target, got %d", code)
+	}
+
+	buf, err := source.targets[0].exec(exporter.ctx, "varnishadm", "panic.show")
+	if err == nil || !strings.Contains(buf.String(), "command not found: varnishadm panic.show") {
+		t.Errorf("expected failed command, got %q: %v", buf, err)
+	}
+}
+
+func Test_SSHPool(t *testing.T) {
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	clientKey, err := ssh.NewSignerFromKey(clientPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address, _ := newFakeSSHServer(t, hostKey, clientKey.PublicKey(), nil)
+	pool := newSSHPool(&ssh.ClientConfig{
+		User:            "varnish",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		Timeout:         5 * time.Second,
+	})
+
+	// A host accepting connections without ever answering the handshake
+	slow, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { slow.Close() })
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := slow.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	slowCtx, cancelSlow := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancelSlow()
+	go pool.run(slowCtx, "varnish", slow.Addr().String(), "varnishstat -V")
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow host was not dialed")
+	}
+
+	// Other hosts are not blocked by the handshake in progress
+	start := time.Now()
+	buf, err := pool.run(context.Background(), "varnish", address, "varnishstat -V")
+	if err != nil || !strings.Contains(buf.String(), "varnish-6.5.1") {
+		t.Fatalf("unexpected output %q: %v", buf, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("command waited for the slow host for %s", elapsed)
+	}
+
+	// The output written before a cancel is returned
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	buf, err = pool.run(ctx, "varnish", address, "hang")
+	if err != context.DeadlineExceeded || buf.String() != "partial" {
+		t.Errorf("expected partial output and deadline exceeded, got %q: %v", buf, err)
+	}
+}
+
+func Test_ShellCommand(t *testing.T) {
+	if cmd := shellCommand("varnishstat", "-j", "-n", "/var/lib/varnish/my instance", "it's"); cmd != `varnishstat -j -n '/var/lib/varnish/my instance' 'it'\''s'` {
+		t.Errorf("unexpected command %s", cmd)
+	}
+}
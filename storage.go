@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Groups of stevedores with the counters of the bytes in use and free per storage, e.g. SMA.s0.g_bytes.
+var storageGroups = map[string]storageCounters{
+	"sma":       {used: "g_bytes", free: "g_space"},
+	"smf":       {used: "g_bytes", free: "g_space"},
+	"smu":       {used: "g_bytes", free: "g_space"},
+	"smp":       {used: "g_bytes", free: "g_space"},
+	"mse":       {used: "g_bytes", free: "g_space"},
+	"mse_store": {used: "g_alloc_bytes", free: "g_free_bytes"},
+}
+
+type storageCounters struct {
+	used string
+	free string
+}
+
+type storageUsage struct {
+	stevedore string
+	storage   string
+	bytes     float64
+	space     float64
+	hasBytes  bool
+	hasSpace  bool
+}
+
+// storageUsages collects the g_bytes and g_space of each storage during a scrape,
+// to derive the utilization from.
+type storageUsages map[string]*storageUsage
+
+// Records the counter if it is the used or free bytes of a storage. The storage
+// label is the same as the type or store label, the ident of Varnish < 5.2 as is.
+func (s storageUsages) observe(vGroup, vName, vIdentifier string, value float64) {
+	counters, ok := storageGroups[vGroup]
+	if !ok {
+		return
+	}
+	// <STEVEDORE>.<storage>.<counter>
+	first, last := strings.Index(vName, "."), strings.LastIndex(vName, ".")
+	if first == last {
+		return
+	}
+	storage, counter := vIdentifier, vName[last+1:]
+	if storage == "" {
+		storage = strings.ToLower(vName[first+1 : last])
+	}
+	if counter != counters.used && counter != counters.free {
+		return
+	}
+	key := vGroup + "." + storage
+	usage := s[key]
+	if usage == nil {
+		usage = &storageUsage{stevedore: vGroup, storage: storage}
+		s[key] = usage
+	}
+	if counter == counters.used {
+		usage.bytes, usage.hasBytes = value, true
+	} else {
+		usage.space, usage.hasSpace = value, true
+	}
+}
+
+// Sends varnish_storage_utilization_ratio of each storage with both used and free bytes.
+// Transient is skipped, it is unbounded by default and would always be full.
+func (s storageUsages) collect(ctx context.Context, ch chan<- prometheus.Metric, target *scrapeTarget) {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labelKeys := append([]string{"stevedore", "storage"}, target.labelKeys...)
+	descKey := "varnish_storage_utilization_ratio_" + strings.Join(labelKeys, "_")
+	desc := DescCache.Desc(descKey)
+	for _, key := range keys {
+		usage := s[key]
+		if !usage.hasBytes || !usage.hasSpace || usage.bytes+usage.space <= 0 || strings.EqualFold(usage.storage, "transient") {
+			continue
+		}
+		if desc == nil {
+			desc = DescCache.Set(descKey, prometheus.NewDesc(
+				"varnish_storage_utilization_ratio",
+				"Ratio of the storage in use, g_bytes / (g_bytes + g_space), g_alloc_bytes / (g_alloc_bytes + g_free_bytes) for MSE stores.",
+				labelKeys,
+				nil,
+			))
+		}
+		metric, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, usage.bytes/(usage.bytes+usage.space),
+			append([]string{usage.stevedore, usage.storage}, target.labelValues...)...)
+		if err != nil {
+			logParse.DebugContext(ctx, "Failed to export storage utilization", "storage", key, "err", err)
+			continue
+		}
+		ch <- metric
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func Test_StorageUtilization(t *testing.T) {
+	stats := `{"version": 1, "counters": {
+		"SMA.s0.g_bytes": {"flag": "g", "format": "B", "value": 25},
+		"SMA.s0.g_space": {"flag": "g", "format": "B", "value": 75},
+		"SMA.Transient.g_bytes": {"flag": "g", "format": "B", "value": 400},
+		"SMA.Transient.g_space": {"flag": "g", "format": "B", "value": 0},
+		"SMA.empty.g_bytes": {"flag": "g", "format": "B", "value": 0},
+		"SMA.empty.g_space": {"flag": "g", "format": "B", "value": 0},
+		"SMF.disk.g_bytes": {"flag": "g", "format": "B", "value": 90},
+		"SMF.disk.g_space": {"flag": "g", "format": "B", "value": 10},
+		"SMU.u0.g_bytes": {"flag": "g", "format": "B", "value": 1},
+		"SMU.u0.g_space": {"flag": "g", "format": "B", "value": 1},
+		"SMU.u0.c_req": {"flag": "c", "format": "i", "value": 5},
+		"SMP.silo.g_bytes": {"flag": "g", "format": "B", "value": 30},
+		"SMP.silo.g_space": {"flag": "g", "format": "B", "value": 70},
+		"MSE.mse.g_bytes": {"flag": "g", "format": "B", "value": 0},
+		"MSE.mse.g_space": {"flag": "g", "format": "B", "value": 100},
+		"MSE_STORE.store1.g_alloc_bytes": {"flag": "g", "format": "B", "value": 60},
+		"MSE_STORE.store1.g_free_bytes": {"flag": "g", "format": "B", "value": 40},
+		"MSE_BOOK.book1.g_bytes": {"flag": "g", "format": "B", "value": 5},
+		"MSE_BOOK.book1.g_space": {"flag": "g", "format": "B", "value": 5}
+	}}`
+	target := newScrapeTarget("test", []string{"host"}, []string{"cache1"}, nil)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+		if _, err := ScrapeVarnishFrom(context.Background(), target, []byte(stats), ch, nil); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ratios := make(map[string]float64)
+	// The stevedore metrics keep their labels, only the ratio has the storage label
+	stevedoreLabels := make(map[string]bool)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			switch family.GetName() {
+			case "varnish_storage_utilization_ratio":
+				if labels["host"] != "cache1" {
+					t.Errorf("missing target label: %v", labels)
+				}
+				ratios[labels["stevedore"]+" "+labels["storage"]] = m.GetGauge().GetValue()
+			default:
+				var pairs []string
+				for _, label := range m.GetLabel() {
+					pairs = append(pairs, label.GetName()+"="+label.GetValue())
+				}
+				stevedoreLabels[family.GetName()+" "+strings.Join(pairs, ",")] = true
+			}
+		}
+	}
+	t.Logf("varnish_storage_utilization_ratio %v", ratios)
+	expected := map[string]float64{
+		"sma s0":           0.25,
+		"smf disk":         0.9,
+		"smu u0":           0.5,
+		"smp silo":         0.3,
+		"mse mse":          0,
+		"mse_store store1": 0.6,
+	}
+	if len(ratios) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, ratios)
+	}
+	for storage, ratio := range expected {
+		if value, ok := ratios[storage]; !ok || value != ratio {
+			t.Errorf("%s: expected %v, got %v", storage, ratio, value)
+		}
+	}
+	for name, labels := range map[string]string{
+		"varnish_sma_g_bytes":             "host=cache1,type=s0",
+		"varnish_smf_g_space":             "host=cache1,type=disk",
+		"varnish_smu_c_req":               "host=cache1,type=u0",
+		"varnish_smp_g_bytes":             "host=cache1,type=silo",
+		"varnish_mse_g_bytes":             "host=cache1,store=mse",
+		"varnish_mse_store_g_alloc_bytes": "host=cache1,store=store1",
+		"varnish_mse_book_g_bytes":        "book=book1,host=cache1",
+	} {
+		if !stevedoreLabels[name+" "+labels] {
+			t.Errorf("%s: expected labels %s", name, labels)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Runs a Varnish tool like varnishstat or varnishadm for a target.
+type toolExecutor func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error)
+
+// scrapeTarget is a single Varnish instance scraped on each collect.
+type scrapeTarget struct {
+	// Held while the target is scraped, the state below is updated by each scrape.
+	scrapeMu sync.Mutex
+
+	// Unique name of the target, used in logging and to track state between scrapes.
+	name string
+	// Source label keys and the target's values, set to all metrics of the target.
+	labelKeys   []string
+	labelValues []string
+	exec        toolExecutor
+	version     *varnishVersion
+	// varnishstat and varnishadm -n and -N, the command line values unless set by the source.
+	params *varnishstatParams
+	// VCLs whose VBE counters are skipped, from the latest vcl.list with -vcl.skip-cold or -vcl.active-only
+	skippedVCLs map[string]bool
+}
+
+func newScrapeTarget(name string, labelKeys, labelValues []string, exec toolExecutor) *scrapeTarget {
+	return &scrapeTarget{
+		name:        name,
+		labelKeys:   labelKeys,
+		labelValues: labelValues,
+		exec:        exec,
+		version:     NewVarnishVersion(),
+		params:      StartParams.Params,
+	}
+}
+
+// Queries the varnishstat version if not yet known.
+func (t *scrapeTarget) initializeVersion(ctx context.Context) error {
+	if t.version.Valid() {
+		return nil
+	}
+	if err := t.version.queryVersion(ctx, t.exec); err != nil {
+		return err
+	}
+	logScrape.InfoContext(ctx, "Found varnishstat", "varnish_version", t.version.String())
+	return nil
+}
+
+// targetSource resolves the Varnish instances to scrape.
+type targetSource interface {
+	// Label keys set to all metrics, the values are given by each target.
+	LabelKeys() []string
+	// Returns the current targets. Called on each collect, implementations should
+	// return the same *scrapeTarget for an instance between calls.
+	Targets(ctx context.Context) ([]*scrapeTarget, error)
+}
+
+// localSource is the default source, varnishstat on this host.
+type localSource struct {
+	target *scrapeTarget
+}
+
+func newLocalSource() *localSource {
+	name := StartParams.Params.Instance
+	if name == "" {
+		name = "local"
+	}
+	target := newScrapeTarget(name, nil, nil, localExecutor())
+	// Shared with main for the startup version check
+	target.version = VarnishVersion
+	return &localSource{target: target}
+}
+
+func (s *localSource) LabelKeys() []string {
+	return nil
+}
+
+func (s *localSource) Targets(ctx context.Context) ([]*scrapeTarget, error) {
+	return []*scrapeTarget{s.target}, nil
+}
+
+// Returns true if m has the source labels of target.
+func hasTargetLabels(m prometheus.Metric, target *scrapeTarget) bool {
+	pb := &dto.Metric{}
+	if err := m.Write(pb); err != nil {
+		return false
+	}
+	matched := 0
+	for _, label := range pb.GetLabel() {
+		for i, key := range target.labelKeys {
+			if label.GetName() == key && label.GetValue() == target.labelValues[i] {
+				matched++
+			}
+		}
+	}
+	return matched == len(target.labelKeys)
+}
+
+// Returns the label values for keys from labels. Missing labels get an empty value.
+func labelValuesFor(keys []string, labels map[string]string) []string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = labels[key]
+	}
+	return values
+}
+
+// Converts a free form name like a Kubernetes or Docker label into a valid Prometheus label name.
+func sanitizeLabelName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_':
+			b.WriteRune(r)
+		case r >= '0' && r <= '9':
+			if i == 0 {
+				b.WriteRune('_')
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+// Returns the targets sorted by name, for stable scrape and log order.
+func sortTargets(targets []*scrapeTarget) []*scrapeTarget {
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].name < targets[j].name
+	})
+	return targets
+}
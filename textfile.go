@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+type textfileParams struct {
+	Directory string
+	Timeout   time.Duration
+}
+
+func (p *textfileParams) enabled() bool {
+	return p.Directory != ""
+}
+
+// textfileCollector exports the metrics of the *.prom files and of the output of the
+// executable files in a directory, as the node_exporter textfile collector. A file
+// that fails to read, run or parse is skipped whole and reported in its scrape error.
+type textfileCollector struct {
+	directory string
+	timeout   time.Duration
+
+	scrapeError    *prometheus.Desc
+	directoryError *prometheus.Desc
+	mtime          *prometheus.Desc
+}
+
+func newTextfileCollector(params *textfileParams) *textfileCollector {
+	return &textfileCollector{
+		directory: params.Directory,
+		timeout:   params.Timeout,
+		scrapeError: prometheus.NewDesc(
+			exporterNamespace+"_exporter_textfile_scrape_error",
+			"1 if reading, running or parsing the -textfile.directory file failed, 0 otherwise.",
+			[]string{"file"}, nil,
+		),
+		directoryError: prometheus.NewDesc(
+			exporterNamespace+"_exporter_textfile_directory_error",
+			"1 if listing the -textfile.directory failed, 0 otherwise.",
+			nil, nil,
+		),
+		mtime: prometheus.NewDesc(
+			exporterNamespace+"_exporter_textfile_mtime_seconds",
+			"Unix timestamp of the last modification of the -textfile.directory *.prom file.",
+			[]string{"file"}, nil,
+		),
+	}
+}
+
+// Describe sends the descriptors of the scrape error and mtime metrics to ch. The metrics
+// of the files are not described, their names are only known once the files are read.
+func (c *textfileCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.scrapeError
+	ch <- c.directoryError
+	ch <- c.mtime
+}
+
+// Collect sends the metrics of the files in the directory to ch, and their scrape errors.
+func (c *textfileCollector) Collect(ctx context.Context, ch chan<- prometheus.Metric) {
+	entries, err := os.ReadDir(c.directory)
+	if err != nil {
+		logTextfile.ErrorContext(ctx, "Reading textfile directory failed", "err", err)
+		ch <- prometheus.MustNewConstMetric(c.directoryError, prometheus.GaugeValue, 1)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.directoryError, prometheus.GaugeValue, 0)
+
+	// Names are exported by the first file in name order
+	seen := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		var families map[string]*dto.MetricFamily
+		if strings.HasSuffix(name, ".prom") {
+			ch <- prometheus.MustNewConstMetric(c.mtime, prometheus.GaugeValue, float64(info.ModTime().UnixNano())/1e9, name)
+			families, err = c.readFile(name)
+		} else if info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			families, err = c.runScript(ctx, name)
+		} else {
+			continue
+		}
+
+		var metrics []prometheus.Metric
+		if err == nil {
+			metrics, err = textfileMetrics(families, name, seen)
+		}
+		scrapeError := 0.0
+		if err != nil {
+			logTextfile.WarnContext(ctx, "Skipping textfile", "file", name, "err", err)
+			scrapeError = 1
+		} else {
+			for _, m := range metrics {
+				ch <- m
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(c.scrapeError, prometheus.GaugeValue, scrapeError, name)
+	}
+}
+
+func (c *textfileCollector) readFile(name string) (map[string]*dto.MetricFamily, error) {
+	f, err := os.Open(filepath.Join(c.directory, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(f)
+}
+
+// Runs the executable and parses its output, the executable is killed after the timeout.
+func (c *textfileCollector) runScript(ctx context.Context, name string) (map[string]*dto.MetricFamily, error) {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, filepath.Join(c.directory, name))
+	cmd.Dir = c.directory
+	cmd.WaitDelay = time.Second
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out after %s", c.timeout)
+		}
+		return nil, fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(stdout)
+}
+
+// Returns the families as metrics, an error if any of them can't be exported. The names are
+// added to seen, the names seen in earlier files and of the exporter itself are errors.
+func textfileMetrics(families map[string]*dto.MetricFamily, file string, seen map[string]string) ([]prometheus.Metric, error) {
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var metrics []prometheus.Metric
+	for _, name := range names {
+		family := families[name]
+		if strings.HasPrefix(name, exporterNamespace+"_") {
+			return nil, fmt.Errorf("%s: metric names starting with %s_ are reserved for the exporter", name, exporterNamespace)
+		}
+		if other, ok := seen[name]; ok {
+			return nil, fmt.Errorf("%s: already exported from %s", name, other)
+		}
+
+		// Missing labels are added with empty values, as by the node_exporter
+		var labelKeys []string
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if indexOf(labelKeys, label.GetName()) == -1 {
+					labelKeys = append(labelKeys, label.GetName())
+				}
+			}
+		}
+		sort.Strings(labelKeys)
+		desc := prometheus.NewDesc(name, family.GetHelp(), labelKeys, nil)
+
+		series := make(map[string]bool)
+		for _, m := range family.GetMetric() {
+			if m.TimestampMs != nil {
+				return nil, fmt.Errorf("%s: timestamps are not supported", name)
+			}
+			labelValues := make([]string, len(labelKeys))
+			for _, label := range m.GetLabel() {
+				labelValues[indexOf(labelKeys, label.GetName())] = label.GetValue()
+			}
+			key := strings.Join(labelValues, "\xff")
+			if series[key] {
+				return nil, fmt.Errorf("%s: duplicate series %v", name, labelValues)
+			}
+			series[key] = true
+
+			metric, err := textfileMetric(desc, family.GetType(), m, labelValues)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err)
+			}
+			metrics = append(metrics, metric)
+		}
+	}
+	for _, name := range names {
+		seen[name] = file
+	}
+	return metrics, nil
+}
+
+func textfileMetric(desc *prometheus.Desc, typ dto.MetricType, m *dto.Metric, labelValues []string) (prometheus.Metric, error) {
+	switch typ {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue(), labelValues...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue(), labelValues...)
+	case dto.MetricType_UNTYPED:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue(), labelValues...)
+	case dto.MetricType_SUMMARY:
+		quantiles := make(map[float64]float64)
+		for _, q := range m.GetSummary().GetQuantile() {
+			quantiles[q.GetQuantile()] = q.GetValue()
+		}
+		return prometheus.NewConstSummary(desc, m.GetSummary().GetSampleCount(), m.GetSummary().GetSampleSum(), quantiles, labelValues...)
+	case dto.MetricType_HISTOGRAM:
+		buckets := make(map[float64]uint64)
+		for _, b := range m.GetHistogram().GetBucket() {
+			buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+		}
+		return prometheus.NewConstHistogram(desc, m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum(), buckets, labelValues...)
+	}
+	return nil, fmt.Errorf("unsupported metric type %s", typ)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type textfileTestCollector struct {
+	*textfileCollector
+}
+
+func (c textfileTestCollector) Collect(ch chan<- prometheus.Metric) {
+	c.textfileCollector.Collect(context.Background(), ch)
+}
+
+// Writes the files to a new directory, files with a .sh suffix are executable.
+func writeTextfiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0755
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func Test_Textfile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Scripts need /bin/sh")
+	}
+	files := map[string]string{
+		"a.prom": `# HELP vcl_revision_info Deployed VCL revision
+# TYPE vcl_revision_info gauge
+vcl_revision_info{revision="abc123",vcl="boot"} 1
+vcl_revision_info{vcl="reload_1"} 1
+# TYPE purge_duration_seconds histogram
+purge_duration_seconds_bucket{le="0.1"} 3
+purge_duration_seconds_bucket{le="+Inf"} 4
+purge_duration_seconds_sum 1.5
+purge_duration_seconds_count 4
+`,
+		"b_duplicate.prom":        "vcl_revision_info 1\n",
+		"c_invalid.prom":          "purge_queue_length{ 1\n",
+		"d_reserved.prom":         "varnish_up 0\n",
+		"e_timestamp.prom":        "purge_queue_length 1 1600000000000\n",
+		"f_script.sh":             "#!/bin/sh\necho '# TYPE purge_queue_length gauge'\necho 'purge_queue_length 12'\n",
+		"g_failing.sh":            "#!/bin/sh\necho 'not found' >&2\nexit 3\n",
+		"h_slow.sh":               "#!/bin/sh\nexec sleep 5\n",
+		"README.md":               "Not a textfile, not executable\n",
+		".hidden.prom":            "hidden 1\n",
+		"i_duplicate_series.prom": "purges_total{type=\"ban\"} 1\npurges_total{type=\"ban\"} 2\n",
+	}
+	dir := writeTextfiles(t, files)
+	if err := os.Mkdir(filepath.Join(dir, "subdir.prom"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := newTextfileCollector(&textfileParams{Directory: dir, Timeout: 200 * time.Millisecond})
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(textfileTestCollector{collector})
+	start := time.Now()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("slow script was not killed after the timeout, gather took %s", elapsed)
+	}
+
+	series := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, label := range m.GetLabel() {
+				labels = append(labels, label.GetName()+"="+label.GetValue())
+			}
+			value := m.GetGauge().GetValue() + m.GetUntyped().GetValue() + float64(m.GetHistogram().GetSampleCount())
+			series[family.GetName()+"{"+strings.Join(labels, ",")+"}"] = value
+		}
+	}
+	t.Logf("%v", series)
+
+	for name, value := range map[string]float64{
+		`vcl_revision_info{revision=abc123,vcl=boot}`:                          1,
+		`vcl_revision_info{revision=,vcl=reload_1}`:                            1,
+		`purge_duration_seconds{}`:                                             4,
+		`purge_queue_length{}`:                                                 12,
+		`varnish_exporter_textfile_directory_error{}`:                          0,
+		`varnish_exporter_textfile_scrape_error{file=a.prom}`:                  0,
+		`varnish_exporter_textfile_scrape_error{file=b_duplicate.prom}`:        1,
+		`varnish_exporter_textfile_scrape_error{file=c_invalid.prom}`:          1,
+		`varnish_exporter_textfile_scrape_error{file=d_reserved.prom}`:         1,
+		`varnish_exporter_textfile_scrape_error{file=e_timestamp.prom}`:        1,
+		`varnish_exporter_textfile_scrape_error{file=f_script.sh}`:             0,
+		`varnish_exporter_textfile_scrape_error{file=g_failing.sh}`:            1,
+		`varnish_exporter_textfile_scrape_error{file=h_slow.sh}`:               1,
+		`varnish_exporter_textfile_scrape_error{file=i_duplicate_series.prom}`: 1,
+	} {
+		if actual, ok := series[name]; !ok || actual != value {
+			t.Errorf("expected %s %v, got %v", name, value, actual)
+		}
+	}
+	if _, ok := series[`varnish_exporter_textfile_mtime_seconds{file=a.prom}`]; !ok {
+		t.Error("missing mtime of a.prom")
+	}
+	for name := range series {
+		if strings.Contains(name, "README") || strings.Contains(name, "hidden") || strings.Contains(name, "subdir") || strings.HasPrefix(name, "purges_total") {
+			t.Errorf("unexpected %s", name)
+		}
+	}
+
+	// A missing directory is a directory error, not a scrape error of a file
+	collector = newTextfileCollector(&textfileParams{Directory: filepath.Join(dir, "missing")})
+	registry = prometheus.NewRegistry()
+	registry.MustRegister(textfileTestCollector{collector})
+	if families, err = registry.Gather(); err != nil || len(families) != 1 || families[0].GetName() != "varnish_exporter_textfile_directory_error" || families[0].GetMetric()[0].GetGauge().GetValue() != 1 {
+		t.Errorf("expected a directory error, got %v %v", families, err)
+	}
+}
+
+// The textfile metrics are added to the scrape of all targets.
+func Test_TextfileEndToEnd(t *testing.T) {
+	dir, _ := os.Getwd()
+	fixture := filepath.Join(dir, "test/scrape/6.5.1.json")
+	if !fileExists(fixture) {
+		t.Skipf("Cannot find test file %s", fixture)
+	}
+	previous := *StartParams.Textfile
+	StartParams.Textfile.Directory = writeTextfiles(t, map[string]string{"site.prom": "# HELP purge_queue_length Queued purges\npurge_queue_length 3\n"})
+	t.Cleanup(func() { *StartParams.Textfile = previous })
+
+	setFakeVarnishstat(t, fakeVarnishstatOK, "6.5.1", fixture)
+	families := getTestMetrics(t, newTestExporterServer(t))
+	if value := families["purge_queue_length"].GetMetric()[0].GetUntyped().GetValue(); value != 3 {
+		t.Errorf("expected purge_queue_length 3, got %v", families["purge_queue_length"])
+	}
+	if families["varnish_main_uptime"] == nil || families["varnish_exporter_textfile_scrape_error"] == nil {
+		t.Errorf("expected varnish and textfile metrics, got %d families", len(families))
+	}
+}
@@ -1,68 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"strings"
 )
 
-// logging
-
-func logRaw(format string, args ...interface{}) {
-	fmt.Printf(format+"\n", args...)
-}
-
-func logTitle(format string, args ...interface{}) {
-	logInfo(format, args...)
-
-	title := strings.Repeat("-", len(fmt.Sprintf(format, args...)))
-	if len(title) > 0 {
-		logInfo(title)
-	}
-}
-
-func logInfo(format string, args ...interface{}) {
-	if StartParams.Raw {
-		logRaw(format, args...)
-	} else {
-		logger.Printf(format, args...)
-	}
-}
-
-func logWarn(format string, args ...interface{}) {
-	format = "[WARN] " + format
-	if StartParams.Raw {
-		logRaw(format, args...)
-	} else {
-		logger.Printf(format, args...)
-	}
-}
-
-func logError(format string, args ...interface{}) {
-	format = "[ERROR] " + format
-	if StartParams.Raw {
-		logRaw(format, args...)
-	} else {
-		logger.Printf(format, args...)
-	}
-}
-
-func logFatal(format string, args ...interface{}) {
-	format = "[FATAL] " + format
-	if StartParams.Raw {
-		logRaw(format, args...)
-	} else {
-		logger.Printf(format, args...)
-	}
-	os.Exit(1)
-}
-
-func logFatalError(err error) {
-	if err != nil {
-		logFatal(err.Error())
-	}
-}
-
 // strings
 
 type caseSensitivity int
@@ -104,6 +46,16 @@ func endsWithAny(str string, postfixes []string, cs caseSensitivity) bool {
 	return false
 }
 
+// Returns the first non-empty line of str, trimmed.
+func firstLine(str string) string {
+	for _, line := range strings.Split(str, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			return line
+		}
+	}
+	return ""
+}
+
 // file
 
 // Returns if file/dir in path exists.
@@ -116,16 +68,3 @@ func fileExists(path string) bool {
 	}
 	return true
 }
-
-// data
-
-func stringProperty(data map[string]interface{}, key string) (string, error) {
-	if value, ok := data[key]; ok {
-		if vStr, ok := value.(string); ok {
-			return vStr, nil
-		} else {
-			return "", fmt.Errorf("%s is not a string", key)
-		}
-	}
-	return "", nil
-}
@@ -3,14 +3,16 @@ package main
 import (
 	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os/exec"
-	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -20,154 +22,185 @@ const (
 )
 
 var (
-	DescCache = &descCache{
-		descs: make(map[string]*prometheus.Desc),
-	}
+	DescCache = newDescCache()
 )
 
+// descCache keeps the metric descriptors between scrapes. Descriptors not used
+// for maxIdleScrapes scrapes are evicted, e.g. the backends of discarded VCLs.
 type descCache struct {
 	sync.RWMutex
 
-	descs map[string]*prometheus.Desc
+	descs map[string]*descCacheEntry
+	// Number of sweeps so far, entries are stamped with it when used
+	scrapes        uint64
+	maxIdleScrapes uint64
+	evictions      uint64
+}
+
+type descCacheEntry struct {
+	desc     *prometheus.Desc
+	lastSeen uint64 // atomic
+}
+
+func newDescCache() *descCache {
+	return &descCache{
+		descs: make(map[string]*descCacheEntry),
+	}
 }
 
 func (dc *descCache) Desc(key string) *prometheus.Desc {
 	dc.RLock()
-	desc := dc.descs[key]
-	dc.RUnlock()
-	return desc
+	defer dc.RUnlock()
+	entry := dc.descs[key]
+	if entry == nil {
+		return nil
+	}
+	atomic.StoreUint64(&entry.lastSeen, dc.scrapes)
+	return entry.desc
 }
 
 func (dc *descCache) Set(key string, desc *prometheus.Desc) *prometheus.Desc {
 	dc.Lock()
-	dc.descs[key] = desc
+	dc.descs[key] = &descCacheEntry{desc: desc, lastSeen: dc.scrapes}
 	dc.Unlock()
 	return desc
 }
 
-func ScrapeVarnish(ch chan<- prometheus.Metric) ([]byte, error) {
+// SetMaxIdleScrapes sets after how many scrapes without use descriptors are evicted, 0 never evicts.
+func (dc *descCache) SetMaxIdleScrapes(scrapes int) {
+	dc.Lock()
+	dc.maxIdleScrapes = uint64(scrapes)
+	dc.Unlock()
+}
+
+// Sweep is called after each scrape. It evicts the descriptors that were not
+// used in the last maxIdleScrapes scrapes and returns the number evicted.
+func (dc *descCache) Sweep(ctx context.Context) int {
+	dc.Lock()
+	defer dc.Unlock()
+	dc.scrapes++
+	if dc.maxIdleScrapes == 0 {
+		return 0
+	}
+	evicted := 0
+	for key, entry := range dc.descs {
+		if dc.scrapes-atomic.LoadUint64(&entry.lastSeen) > dc.maxIdleScrapes {
+			delete(dc.descs, key)
+			evicted++
+		}
+	}
+	if evicted > 0 {
+		dc.evictions += uint64(evicted)
+		logCollector.DebugContext(ctx, "Evicted unused metric descriptors", "evicted", evicted, "cached", len(dc.descs))
+	}
+	return evicted
+}
+
+// Returns the number of cached descriptors and evictions so far.
+func (dc *descCache) Stats() (cached int, evictions uint64) {
+	dc.RLock()
+	defer dc.RUnlock()
+	return len(dc.descs), dc.evictions
+}
+
+// Scrapes varnishstat of target and sends the metrics to ch. If tracked is not nil,
+// the values of restartCounters found in the scrape are stored to it.
+func ScrapeVarnish(ctx context.Context, target *scrapeTarget, ch chan<- prometheus.Metric, tracked map[string]float64) ([]byte, error) {
 	params := []string{"-j"}
-	if VarnishVersion.EqualsOrGreater(4, 1) {
+	if target.version.EqualsOrGreater(4, 1) {
 		// 4.1 started to support timeout to exit immediately on connection errors.
 		// Before that varnishstat exits immediately on faulty params or connection errors.
 		params = append(params, "-t", "0")
 	}
-	if !StartParams.Params.isEmpty() {
-		params = append(params, StartParams.Params.make()...)
+	if !target.params.isEmpty() {
+		params = append(params, target.params.make(target.version)...)
+	}
+	if StartParams.SkipColdVCLs || StartParams.VCLActiveOnly {
+		target.skippedVCLs = fetchSkippedVCLs(ctx, target)
+	} else {
+		target.skippedVCLs = nil
+	}
+	buf, errExec := target.exec(ctx, StartParams.VarnishstatExe, params...)
+	if errExec != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return buf.Bytes(), fmt.Errorf("%s scrape timed out after -scrape.timeout %s", StartParams.VarnishstatExe, StartParams.ScrapeTimeout)
 	}
-	buf, errExec := executeVarnishstat(StartParams.VarnishstatExe, params...)
 	if errExec != nil {
+		// e.g. "Could not get hold of varnishd, is it running?"
+		if line := firstLine(buf.String()); line != "" {
+			return buf.Bytes(), fmt.Errorf("%s scrape failed: %s: %s", StartParams.VarnishstatExe, errExec, line)
+		}
 		return buf.Bytes(), fmt.Errorf("%s scrape failed: %s", StartParams.VarnishstatExe, errExec)
 	}
-	return ScrapeVarnishFrom(buf.Bytes(), ch)
+	return ScrapeVarnishFrom(ctx, target, buf.Bytes(), ch, tracked)
 }
 
-func ScrapeVarnishFrom(buf []byte, ch chan<- prometheus.Metric) ([]byte, error) {
-	// The output JSON annoyingly is not structured so that we could make a nice map[string]struct for it.
-	metricsJSON := make(map[string]interface{})
-	dec := json.NewDecoder(bytes.NewBuffer(buf))
-	dec.UseNumber()
-	if err := dec.Decode(&metricsJSON); err != nil {
+// Sends the metrics from varnishstat -j output in buf to ch. The target labels are set to all metrics.
+func ScrapeVarnishFrom(ctx context.Context, target *scrapeTarget, buf []byte, ch chan<- prometheus.Metric, tracked map[string]float64) ([]byte, error) {
+	counters, err := decodeVarnishstat(ctx, buf)
+	if err != nil {
 		return buf, err
 	}
 
-	countersJSON := make(map[string]interface{})
-	// From Varnish 6.5 https://varnish-cache.org/docs/6.5/whats-new/upgrading-6.5.html#varnishstat
-	if metricsJSON["version"] != nil {
-		version_raw, ok := metricsJSON["version"].(json.Number)
-		if !ok {
-			return nil, fmt.Errorf("Unhandled json stats version type: %T %#v", metricsJSON["version"], metricsJSON["version"])
-		}
-		version, err := version_raw.Int64()
-		if err != nil {
-			return nil, fmt.Errorf("Unhandled json stats version type: %s", err)
-		}
-		switch version {
-		case 1:
-			countersJSON = metricsJSON["counters"].(map[string]interface{})
-		default:
-			return nil, fmt.Errorf("Unimplemented json stats version %d", version)
-		}
-	} else {
-		countersJSON = metricsJSON
+	// Without the vcl label only the backends of the most recent reload are kept,
+	// unless the active VCL is known
+	mostRecentVbeReloadPrefix := ""
+	if !StartParams.VCLLabel && !(StartParams.VCLActiveOnly && target.skippedVCLs != nil) {
+		mostRecentVbeReloadPrefix = findMostRecentVbeReloadPrefix(counters)
 	}
 
-	mostRecentVbeReloadPrefix := findMostRecentVbeReloadPrefix(countersJSON)
-
-	for vName, raw := range countersJSON {
+	// Without a guard for the whole scrape in ctx the metrics are guarded here
+	guard, flush := labelGuardFrom(ctx), false
+	if guard == nil {
+		guard, flush = newLabelGuard(StartParams.LabelConflicts, nil, sendMetrics(ch)), true
+	}
 
-		if isOutdatedVbe(vName, mostRecentVbeReloadPrefix) {
-			continue
-		}
-		if vName == "timestamp" {
-			continue
-		}
-		if dt := reflect.TypeOf(raw); dt.Kind() != reflect.Map {
-			if StartParams.Verbose {
-				logWarn("Found unexpected data from json: %s: %#v", vName, raw)
-			}
-			continue
-		}
-		data, ok := raw.(map[string]interface{})
-		if !ok {
-			if StartParams.Verbose {
-				logWarn("Failed to cast to map[string]interface{}: %s: %#v", vName, raw)
-			}
+	storage := make(storageUsages)
+	for _, counter := range counters {
+		vName := counter.Name
+		vcl := vbeVCLName(vName, target.version)
+		if isOutdatedVbe(vName, mostRecentVbeReloadPrefix) || target.skippedVCLs[vcl] {
 			continue
 		}
 		var (
 			vGroup       = prometheusGroup(vName)
-			vDescription string
-			vIdentifier  string
+			vDescription = counter.Description
+			vIdentifier  = counter.Ident
 			vValue       float64
 			iValue       uint64
 			vErr         error
 		)
-		flag, _ := stringProperty(data, "flag")
-
-		if value, ok := data["description"]; ok && vErr == nil {
-			if vDescription, ok = value.(string); !ok {
-				vErr = fmt.Errorf("%s description it not a string", vName)
-			}
-		}
-		if value, ok := data["ident"]; ok && vErr == nil {
-			if vIdentifier, ok = value.(string); !ok {
-				vErr = fmt.Errorf("%s ident it not a string", vName)
-			}
-		}
-		if value, ok := data["value"]; ok && vErr == nil {
-			if number, ok := value.(json.Number); ok {
-				if vValue, vErr = number.Float64(); vErr != nil {
-					vErr = fmt.Errorf("%s value float64 error: %s", vName, vErr)
+		flag := counter.Flag
+
+		if counter.Value != "" {
+			if vValue, vErr = counter.Value.Float64(); vErr != nil {
+				vErr = fmt.Errorf("%s value float64 error: %s", vName, vErr)
+			} else if flag == "b" {
+				if iValue, vErr = strconv.ParseUint(counter.Value.String(), 10, 64); vErr != nil {
+					vErr = fmt.Errorf("%s value uint64 error: %s", vName, vErr)
 				}
-				if flag == "b" {
-					if iValue, vErr = strconv.ParseUint(number.String(), 10, 64); vErr != nil {
-						vErr = fmt.Errorf("%s value uint64 error: %s", vName, vErr)
-					}
-				}
-			} else {
-				vErr = fmt.Errorf("%s value it not a float64", vName)
 			}
 		}
 		if vErr != nil {
-			if StartParams.Verbose {
-				logWarn(vErr.Error())
-			}
+			logParse.DebugContext(ctx, "Failed to parse counter", "counter", vName, "err", vErr)
 			continue
 		}
+		storage.observe(vGroup, vName, vIdentifier, vValue)
+		if tracked != nil {
+			if name := trackedCounterName(vName); name != "" {
+				tracked[name] = vValue
+			}
+		}
 
 		pName, pDescription, pLabelKeys, pLabelValues := computePrometheusInfo(vName, vGroup, vIdentifier, vDescription)
-
-		descKey := pName + "_" + strings.Join(pLabelKeys, "_")
-		pDesc := DescCache.Desc(descKey)
-		if pDesc == nil {
-			pDesc = DescCache.Set(descKey, prometheus.NewDesc(
-				pName,
-				pDescription,
-				pLabelKeys,
-				nil,
-			))
+		if StartParams.VCLLabel && strings.HasPrefix(vName, "VBE.") {
+			if vcl == "" {
+				vcl = "unknown"
+			} else {
+				pLabelValues = trimVCLName(pLabelKeys, pLabelValues, vcl)
+			}
+			pLabelKeys, pLabelValues = append(pLabelKeys, "vcl"), append(pLabelValues, vcl)
 		}
+		pLabelKeys, pLabelValues = append(pLabelKeys, target.labelKeys...), append(pLabelValues, target.labelValues...)
 
 		var metricType prometheus.ValueType
 		switch flag {
@@ -179,44 +212,49 @@ func ScrapeVarnishFrom(buf []byte, ch chan<- prometheus.Metric) ([]byte, error)
 			metricType = prometheus.GaugeValue
 		}
 
-		ch <- prometheus.MustNewConstMetric(pDesc, metricType, vValue, pLabelValues...)
+		guard.Add(ctx, &guardedMetric{
+			counter:     vName,
+			name:        pName,
+			help:        pDescription,
+			valueType:   metricType,
+			value:       vValue,
+			labelKeys:   pLabelKeys,
+			labelValues: pLabelValues,
+		})
 
 		// augment varnish_backend_up from _happy varnish bitmap value
 		// we are only interested in the latest happy value (up or down) on each scrape
 		// see draw_line_bitmap function from https://github.com/varnishcache/varnish-cache/blob/master/bin/varnishstat/varnishstat_curses.c
 		if pName == "varnish_backend_happy" {
-			upName := "varnish_backend_up"
-			upDesc := "Backend up as per the latest health probe"
 			upValue := 0.0
 			if iValue > 0 && (iValue&uint64(1)) > 0 {
 				upValue = 1.0
 			}
-
-			descKey = upName + "_" + strings.Join(pLabelKeys, "_")
-			pDesc = DescCache.Desc(descKey)
-			if pDesc == nil {
-				pDesc = DescCache.Set(descKey, prometheus.NewDesc(
-					upName,
-					upDesc,
-					pLabelKeys,
-					nil,
-				))
-			}
-			ch <- prometheus.MustNewConstMetric(pDesc, prometheus.GaugeValue, upValue, pLabelValues...)
+			guard.Add(ctx, &guardedMetric{
+				counter:     vName,
+				name:        "varnish_backend_up",
+				help:        "Backend up as per the latest health probe",
+				valueType:   prometheus.GaugeValue,
+				value:       upValue,
+				labelKeys:   pLabelKeys,
+				labelValues: pLabelValues,
+			})
 		}
 	}
+	if flush {
+		guard.Flush(ctx)
+	}
+	storage.collect(ctx, ch, target)
 	return buf, nil
 }
 
-// Returns the result of 'varnishtat' with optional command line params.
-func executeVarnishstat(varnishstatExe string, params ...string) (*bytes.Buffer, error) {
+// Returns the result of a Varnish tool like 'varnishstat' or 'varnishadm' with optional command line params.
+// The process is killed if ctx is done before it exits.
+func executeVarnishTool(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
 	buf := &bytes.Buffer{}
-	var cmd *exec.Cmd
-	if len(StartParams.VarnishDockerContainer) == 0 {
-		cmd = exec.Command(varnishstatExe, params...)
-	} else {
-		cmd = exec.Command("docker", append([]string{"exec", "-t", StartParams.VarnishDockerContainer, varnishstatExe}, params...)...)
-	}
+	cmd := exec.CommandContext(ctx, exe, params...)
+	// Don't wait forever for output pipes held open by grandchildren after a kill
+	cmd.WaitDelay = time.Second
 	cmd.Stdout = buf
 	cmd.Stderr = buf
 	return buf, cmd.Run()
@@ -225,9 +263,10 @@ func executeVarnishstat(varnishstatExe string, params ...string) (*bytes.Buffer,
 // Returns the most recent prefix for 'VBE.reload_' stats. Empty until first reload.
 // 'VBE.reload_2019-08-29T100458' as by varnish_reload_vcl in 4.1+
 // 'VBE.reload_20191014_091124_78599' as by varnishreload in 6+
-func findMostRecentVbeReloadPrefix(countersJSON map[string]interface{}) string {
+func findMostRecentVbeReloadPrefix(counters []*varnishstatCounter) string {
 	var mostRecentVbeReloadPrefix string
-	for vName, _ := range countersJSON {
+	for _, counter := range counters {
+		vName := counter.Name
 		// Checking only the required ".happy" stat
 		if strings.HasPrefix(vName, vbeReload) && strings.HasSuffix(vName, ".happy") {
 			dotAfterPrefixIndex := len(vbeReload) + strings.Index(vName[len(vbeReload):], ".")
@@ -275,12 +314,12 @@ func (v *varnishVersion) Valid() bool {
 	return v.Major != -1
 }
 
-func (v *varnishVersion) Initialize() error {
-	return v.queryVersion()
+func (v *varnishVersion) Initialize(ctx context.Context) error {
+	return v.queryVersion(ctx, executeVarnishTool)
 }
 
-func (v *varnishVersion) queryVersion() error {
-	buf, err := executeVarnishstat(StartParams.VarnishstatExe, "-V")
+func (v *varnishVersion) queryVersion(ctx context.Context, exec toolExecutor) error {
+	buf, err := exec(ctx, StartParams.VarnishstatExe, "-V")
 	if err != nil {
 		return err
 	}
@@ -1,17 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
-var testFileVersions = []string{"3.0.5", "4.0.5", "4.1.1", "5.2.0", "6.0.0", "6.5.1"}
+var testFileVersions = []string{"3.0.5", "4.0.5", "4.1.1", "5.2.0", "6.0.0", "6.5.1", "synthetic-6.6.2", "synthetic-7.0.3", "synthetic-7.2.1", "synthetic-7.4.3", "synthetic-7.6.1", "synthetic-6.0.13r6"}
+
+// Prefix of the test/scrape files not captured from varnishstat, see test/scrape/README.md
+const syntheticFixturePrefix = "synthetic-"
+
+// Returns the Varnish version of a test/scrape file name like 7.6.1 or synthetic-7.6.1.
+func fixtureVersion(name string) string {
+	return strings.TrimPrefix(name, syntheticFixturePrefix)
+}
+
+// Target without labels for scraping static files
+var testTarget = newScrapeTarget("test", nil, nil, executeVarnishTool)
 
 func Test_VarnishVersion(t *testing.T) {
 	tests := map[string]*varnishVersion{
@@ -181,7 +199,7 @@ func Test_VarnishMetrics(t *testing.T) {
 			}
 			done <- true
 		}()
-		_, err = ScrapeVarnishFrom(buf, metrics)
+		_, err = ScrapeVarnishFrom(context.Background(), testTarget, buf, metrics, nil)
 		close(metrics)
 		<-done
 
@@ -220,7 +238,11 @@ func Test_FindMostRecentVbeReloadPrefix(t *testing.T) {
 			"VBE.reload_20191016_072034_54501.default.happy": "any",
 		}, "VBE.reload_20191016_072034_54501"},
 	} {
-		computedMostRecentVbeReloadPrefix := findMostRecentVbeReloadPrefix(testConfig.varnishCounters)
+		counters := []*varnishstatCounter{}
+		for vName := range testConfig.varnishCounters {
+			counters = append(counters, &varnishstatCounter{Name: vName})
+		}
+		computedMostRecentVbeReloadPrefix := findMostRecentVbeReloadPrefix(counters)
 		t.Logf("Varnish counters: %s\n", testConfig.varnishCounters)
 		t.Logf("  expected most recent prefix : '%s'\n", testConfig.expectedMostRecentVbeReloadPrefix)
 		t.Logf("  computed most recent prefix : '%s'\n", computedMostRecentVbeReloadPrefix)
@@ -270,13 +292,149 @@ func (tc *testCollector) Collect(ch chan<- prometheus.Metric) {
 	if err != nil {
 		tc.t.Fatal(err.Error())
 	}
-	_, err = ScrapeVarnishFrom(buf, ch)
+	_, err = ScrapeVarnishFrom(context.Background(), testTarget, buf, ch, nil)
 
 	if err != nil {
 		tc.t.Fatal(err.Error())
 	}
 }
 
+func Test_DescCacheEviction(t *testing.T) {
+	dc := newDescCache()
+	dc.SetMaxIdleScrapes(2)
+	desc := func(name string) *prometheus.Desc {
+		return prometheus.NewDesc(name, name, nil, nil)
+	}
+	dc.Set("used", desc("used"))
+	dc.Set("removed", desc("removed"))
+	for i := 0; i < 3; i++ {
+		if dc.Desc("used") == nil {
+			t.Fatalf("scrape %d: used descriptor evicted", i)
+		}
+		dc.Sweep(context.Background())
+	}
+	if dc.Desc("removed") != nil {
+		t.Error("unused descriptor not evicted")
+	}
+	if cached, evictions := dc.Stats(); cached != 1 || evictions != 1 {
+		t.Errorf("expected 1 cached and 1 eviction, got %d and %d", cached, evictions)
+	}
+
+	// Never evicted with 0
+	dc.SetMaxIdleScrapes(0)
+	for i := 0; i < 5; i++ {
+		dc.Sweep(context.Background())
+	}
+	if dc.Desc("used") == nil {
+		t.Error("descriptor evicted with max idle scrapes 0")
+	}
+}
+
+// With ?target= scrapes the descriptors of one target don't age on the scrapes of the others.
+func Test_DescCacheEvictionPerTarget(t *testing.T) {
+	dir, _ := os.Getwd()
+	var targets []*scrapeTarget
+	for _, version := range []string{"6.5.1", "synthetic-6.0.13r6"} {
+		buf, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape", version+".json"))
+		if err != nil {
+			t.Skipf("Cannot read test file: %s", err)
+		}
+		targets = append(targets, newScrapeTarget(version, []string{"host"}, []string{version}, func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+			if len(params) == 1 && params[0] == "-V" {
+				return bytes.NewBufferString("varnishstat (varnish-" + fixtureVersion(version) + " revision 1dae23376bb5ea7a6b8e9e4b9ed95cdc9469fb64)"), nil
+			}
+			return bytes.NewBuffer(buf), nil
+		}))
+	}
+	previous := DescCache
+	DescCache = newDescCache()
+	DescCache.SetMaxIdleScrapes(1)
+	t.Cleanup(func() { DescCache = previous })
+
+	pe := NewPrometheusExporter()
+	if err := pe.Initialize(&testSource{labelKeys: []string{"host"}, targets: targets}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for _, target := range targets {
+			registry := prometheus.NewRegistry()
+			registry.MustRegister(pe.TargetCollector(target.name))
+			if _, err := registry.Gather(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// The MSE descriptors are only used by the synthetic-6.0.13r6 target
+	if _, evictions := DescCache.Stats(); evictions != 0 {
+		t.Errorf("expected no evictions, got %d", evictions)
+	}
+
+	// A target no longer scraped by name doesn't keep the others from being swept
+	for i := 0; i < 6; i++ {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(pe.TargetCollector(targets[0].name))
+		if _, err := registry.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, evictions := DescCache.Stats(); evictions == 0 {
+		t.Error("expected the descriptors of the unscraped target to be evicted")
+	}
+}
+
+// A hanging target doesn't block the ?target= scrapes of the others.
+func Test_ScrapeTargetsConcurrently(t *testing.T) {
+	dir, _ := os.Getwd()
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape/6.5.1.json"))
+	if err != nil {
+		t.Skipf("Cannot read test file: %s", err)
+	}
+	hanging := make(chan struct{})
+	var targets []*scrapeTarget
+	for _, name := range []string{"hanging", "ok"} {
+		name := name
+		targets = append(targets, newScrapeTarget(name, []string{"host"}, []string{name}, func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+			if len(params) == 1 && params[0] == "-V" {
+				return bytes.NewBufferString("varnishstat (varnish-6.5.1 revision 1dae23376bb5ea7a6b8e9e4b9ed95cdc9469fb64)"), nil
+			}
+			if name == "hanging" {
+				close(hanging)
+				<-ctx.Done()
+				return &bytes.Buffer{}, ctx.Err()
+			}
+			return bytes.NewBuffer(buf), nil
+		}))
+	}
+	previous := StartParams.ScrapeTimeout
+	StartParams.ScrapeTimeout = 0
+	t.Cleanup(func() { StartParams.ScrapeTimeout = previous })
+
+	pe := NewPrometheusExporter()
+	if err := pe.Initialize(&testSource{labelKeys: []string{"host"}, targets: targets}); err != nil {
+		t.Fatal(err)
+	}
+	gathered := make(chan error, 2)
+	gather := func(name string) {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(pe.TargetCollector(name))
+		_, err := registry.Gather()
+		gathered <- err
+	}
+	go gather("hanging")
+	<-hanging
+	go gather("ok")
+	select {
+	case err := <-gathered:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrape of the ok target blocked by the hanging target")
+	}
+	pe.Abort(5 * time.Second)
+	<-gathered
+}
+
 func Test_PrometheusExport(t *testing.T) {
 	dir, _ := os.Getwd()
 	if !fileExists(filepath.Join(dir, "test/scrape")) {
@@ -323,6 +481,27 @@ func Test_PrometheusExport(t *testing.T) {
 	}
 }
 
+// A panic while scraping a target fails the scrape instead of the exporter.
+func Test_ScrapePanic(t *testing.T) {
+	target := newScrapeTarget("test", nil, nil, func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+		panic("unexpected varnishstat output")
+	})
+	pe := NewPrometheusExporter()
+	if err := pe.Initialize(&localSource{target: target}); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan prometheus.Metric, 16)
+	err := pe.Scrape(context.Background(), ch)
+	t.Logf("scrape error: %v", err)
+	if err == nil || !strings.Contains(err.Error(), "scrape panicked") {
+		t.Fatalf("expected scrape panicked error, got %v", err)
+	}
+	pb := &dto.Metric{}
+	if err := pe.up.WithLabelValues().Write(pb); err != nil || pb.GetGauge().GetValue() != 0 {
+		t.Errorf("expected varnish_up 0, got %v", pb.GetGauge().GetValue())
+	}
+}
+
 // Testing against a live varnish instance is only executed in build bot(s).
 // This is because the usual end user setup requires tests to be ran with sudo in order to work.
 func Test_VarnishMetrics_CI(t *testing.T) {
@@ -334,10 +513,13 @@ func Test_VarnishMetrics_CI(t *testing.T) {
 		return
 	}
 
-	StartParams.Verbose = true
-	StartParams.Raw = true
+	LogConfig.Level = "debug"
+	if err := LogConfig.Initialize(os.Stdout, true); err != nil {
+		t.Fatal(err)
+	}
 
-	if err := VarnishVersion.Initialize(); err != nil {
+	target := newLocalSource().target
+	if err := target.initializeVersion(context.Background()); err != nil {
 		t.Fatal(err)
 	}
 
@@ -349,9 +531,96 @@ func Test_VarnishMetrics_CI(t *testing.T) {
 		}
 		done <- true
 	}()
-	if _, err := ScrapeVarnish(metrics); err != nil {
+	if _, err := ScrapeVarnish(context.Background(), target, metrics, nil); err != nil {
 		t.Fatal(err)
 	}
 	close(metrics)
 	<-done
 }
+
+func Test_VMODCounterFamilies(t *testing.T) {
+	dir, _ := os.Getwd()
+	test := filepath.Join(dir, "test/scrape/synthetic-6.0.13r6.json")
+	if !fileExists(test) {
+		t.Skipf("Cannot find test file %s", test)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&testCollector{filepath: test, t: t})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := make(map[string][]string)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			var pairs []string
+			for _, label := range m.GetLabel() {
+				pairs = append(pairs, label.GetName()+"="+label.GetValue())
+			}
+			labels[family.GetName()] = append(labels[family.GetName()], strings.Join(pairs, ","))
+		}
+	}
+	for name, expected := range map[string][]string{
+		"varnish_mse_g_bytes":               {"store=mse"},
+		"varnish_mse_n_lru_nuked":           {"store=mse"},
+		"varnish_mse_store_g_alloc_bytes":   {"store=store1", "store=store2"},
+		"varnish_mse_book_g_space":          {"book=book1"},
+		"varnish_kvstore_g_entries":         {"kvstore=ratelimit", "kvstore=sessions"},
+		"varnish_accg_client_req_count":     {"key=api,namespace=default", "key=total,namespace=default", "key=www,namespace=default"},
+		"varnish_accg_diag_set_key_failure": {""},
+		"varnish_main_n_object":             {""},
+		"varnish_sma_g_bytes":               {"type=transient"},
+	} {
+		t.Logf("%s %v", name, labels[name])
+		sort.Strings(labels[name])
+		if !matchStringSlices(labels[name], expected) {
+			t.Errorf("%s: expected labels %v, got %v", name, expected, labels[name])
+		}
+	}
+	for name := range labels {
+		if strings.HasPrefix(name, "varnish_main_mse") || strings.HasPrefix(name, "varnish_main_kvstore") || strings.HasPrefix(name, "varnish_main_accg") {
+			t.Errorf("VMOD counter in main group: %s", name)
+		}
+	}
+}
+
+// Any counter name and ident must give a valid metric name with one value per
+// unique label. Run with
+// go test -run none -fuzz Fuzz_ComputePrometheusInfo
+func Fuzz_ComputePrometheusInfo(f *testing.F) {
+	ctx := context.Background()
+	for _, file := range readScrapeFiles(f) {
+		counters, err := decodeVarnishstat(ctx, file.buf)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, counter := range counters {
+			f.Add(counter.Name, counter.Ident, counter.Description)
+		}
+	}
+	for _, seed := range [][]string{
+		{"VBE..", "", ""},
+		{"MAIN..", "", ""},
+		{"SMA.s0", "", ""},
+		{"main.sess_x.y", "", ""},
+		{"LCK.a-b.c d.locks", "", ""},
+		{"ACCG.ns", "ns", ""},
+		{"MAIN.İ.x.y", "", ""},
+	} {
+		f.Add(seed[0], seed[1], seed[2])
+	}
+	f.Fuzz(func(t *testing.T, vName, vIdentifier, vDescription string) {
+		if !utf8.ValidString(vName) || !utf8.ValidString(vIdentifier) {
+			// Decoded from JSON, always valid
+			return
+		}
+		name, description, labelKeys, labelValues := computePrometheusInfo(vName, prometheusGroup(vName), vIdentifier, vDescription)
+		if len(labelKeys) != len(labelValues) {
+			t.Fatalf("%q: label keys %v and values %v", vName, labelKeys, labelValues)
+		}
+		desc := prometheus.NewDesc(name, description, labelKeys, nil)
+		if _, err := prometheus.NewConstMetric(desc, prometheus.GaugeValue, 1, labelValues...); err != nil {
+			t.Fatalf("%q ident %q: %s", vName, vIdentifier, err)
+		}
+	})
+}
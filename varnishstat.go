@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// varnishstatCounter is a single counter of varnishstat -j output.
+type varnishstatCounter struct {
+	Name        string      `json:"-"`
+	Description string      `json:"description"`
+	Ident       string      `json:"ident"` // Varnish < 5.2
+	Flag        string      `json:"flag"`
+	Format      string      `json:"format"`
+	Value       json.Number `json:"value"`
+}
+
+// varnishstatOutput is the varnishstat -j output as streamed from the JSON,
+// before the format version is known.
+type varnishstatOutput struct {
+	Version int
+	// Counter objects in the top level object, Varnish < 6.5
+	TopLevel []*varnishstatCounter
+	// Counter objects in "counters", Varnish >= 6.5
+	Counters    []*varnishstatCounter
+	HasCounters bool
+}
+
+// varnishstatDecoder returns the counters of a varnishstat -j JSON format version.
+type varnishstatDecoder func(ctx context.Context, output *varnishstatOutput) ([]*varnishstatCounter, error)
+
+// Decoders by the "version" of the JSON output. Add a decoder here when
+// varnishstat changes its output format.
+var varnishstatDecoders = map[int]varnishstatDecoder{
+	// Varnish < 6.5 has no version, the counters are in the top level object with "timestamp".
+	0: decodeVarnishstatV0,
+	// From Varnish 6.5 https://varnish-cache.org/docs/6.5/whats-new/upgrading-6.5.html#varnishstat
+	1: decodeVarnishstatV1,
+}
+
+// Unknown newer format versions are logged once, per version
+var varnishstatUnknownVersions sync.Map
+
+// Decodes varnishstat -j output with the decoder of its format version. Newer
+// versions than we know of are decoded with the latest decoder, so a Varnish
+// upgrade keeps the metrics flowing if the counters are still where we expect them.
+func decodeVarnishstat(ctx context.Context, buf []byte) ([]*varnishstatCounter, error) {
+	output, err := streamVarnishstat(ctx, json.NewDecoder(bytes.NewReader(buf)))
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := varnishstatDecoders[output.Version]
+	if decoder == nil {
+		latest := latestVarnishstatVersion()
+		if output.Version < latest {
+			return nil, fmt.Errorf("Unimplemented json stats version %d", output.Version)
+		}
+		if _, logged := varnishstatUnknownVersions.LoadOrStore(output.Version, true); !logged {
+			logParse.WarnContext(ctx, "Unknown varnishstat json version, decoding as the latest known version. Please report an issue if metrics are missing.",
+				"json_version", output.Version, "decoded_as", latest)
+		}
+		decoder = varnishstatDecoders[latest]
+	}
+	counters, err := decoder(ctx, output)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		return counters[i].Name < counters[j].Name
+	})
+	return counters, nil
+}
+
+func latestVarnishstatVersion() int {
+	latest := 0
+	for version := range varnishstatDecoders {
+		if version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
+func decodeVarnishstatV0(ctx context.Context, output *varnishstatOutput) ([]*varnishstatCounter, error) {
+	return output.TopLevel, nil
+}
+
+func decodeVarnishstatV1(ctx context.Context, output *varnishstatOutput) ([]*varnishstatCounter, error) {
+	if !output.HasCounters {
+		return nil, fmt.Errorf("No counters in json stats version %d", output.Version)
+	}
+	return output.Counters, nil
+}
+
+// Streams the top level object, only the object structure is read token by
+// token. Counters are decoded straight into varnishstatCounter, whichever order
+// "version" and the counters come in.
+func streamVarnishstat(ctx context.Context, dec *json.Decoder) (*varnishstatOutput, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	output := &varnishstatOutput{}
+	for dec.More() {
+		key, err := objectKey(dec)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "version":
+			var version json.RawMessage
+			if err := dec.Decode(&version); err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(version, &output.Version); err != nil {
+				return nil, fmt.Errorf("Unhandled json stats version %s: %s", version, err)
+			}
+		case "timestamp":
+			if err := dec.Decode(&json.RawMessage{}); err != nil {
+				return nil, err
+			}
+		case "counters":
+			if err := expectDelim(dec, '{'); err != nil {
+				return nil, fmt.Errorf("Invalid counters in json stats: %s", err)
+			}
+			for dec.More() {
+				name, err := objectKey(dec)
+				if err != nil {
+					return nil, err
+				}
+				counter, err := streamVarnishstatCounter(ctx, dec, name)
+				if err != nil {
+					return nil, err
+				}
+				if counter != nil {
+					output.Counters = append(output.Counters, counter)
+				}
+			}
+			if err := expectDelim(dec, '}'); err != nil {
+				return nil, err
+			}
+			output.HasCounters = true
+		default:
+			counter, err := streamVarnishstatCounter(ctx, dec, key)
+			if err != nil {
+				return nil, err
+			}
+			if counter != nil {
+				output.TopLevel = append(output.TopLevel, counter)
+			}
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return output, nil
+}
+
+// Decodes the next value as the counter name. Returns nil without an error for
+// a counter that is not as expected, the error is for broken JSON.
+func streamVarnishstatCounter(ctx context.Context, dec *json.Decoder, name string) (*varnishstatCounter, error) {
+	counter := &varnishstatCounter{Name: name}
+	if err := dec.Decode(counter); err != nil {
+		// The decoder is past the value unless the JSON itself is broken
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+		logParse.DebugContext(ctx, "Failed to parse counter", "counter", name, "err", err)
+		return nil, nil
+	}
+	return counter, nil
+}
+
+func objectKey(dec *json.Decoder) (string, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := token.(string)
+	if !ok {
+		return "", fmt.Errorf("Unexpected json object key %v", token)
+	}
+	return key, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("Unexpected json %v, expected %s", token, delim)
+	}
+	return nil
+}
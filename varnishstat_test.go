@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func Test_DecodeVarnishstat(t *testing.T) {
+	ctx := context.Background()
+	for _, test := range []struct {
+		name     string
+		json     string
+		counters []string
+		err      string
+	}{
+		{"before 6.5", `{"timestamp": "2019-01-01T00:00:00", "MAIN.uptime": {"flag": "c", "value": 1}}`, []string{"MAIN.uptime"}, ""},
+		{"version 1", `{"version": 1, "timestamp": "2021-01-01T00:00:00", "counters": {"MAIN.uptime": {"flag": "c", "value": 1}, "MGT.uptime": {"flag": "c", "value": 2}}}`, []string{"MAIN.uptime", "MGT.uptime"}, ""},
+		{"version after counters", `{"counters": {"MAIN.uptime": {"flag": "c", "value": 1}}, "timestamp": "2021-01-01T00:00:00", "version": 1}`, []string{"MAIN.uptime"}, ""},
+		{"future version", `{"version": 99, "counters": {"MAIN.uptime": {"flag": "c", "value": 1}}}`, []string{"MAIN.uptime"}, ""},
+		{"invalid counters skipped", `{"version": 1, "counters": {"MAIN.a": {"value": "x"}, "MAIN.b": 5, "MAIN.c": {"description": 1}, "MAIN.d": {"value": 4}}}`, []string{"MAIN.d"}, ""},
+		{"negative version", `{"version": -1, "counters": {}}`, nil, "Unimplemented json stats version -1"},
+		{"version not a number", `{"version": "1", "counters": {}}`, nil, "Unhandled json stats version"},
+		{"no counters", `{"version": 1}`, nil, "No counters"},
+		{"not json", `Could not get hold of varnishd, is it running?`, nil, "invalid character"},
+		{"truncated", `{"version": 1, "counters": {"MAIN.uptime": {"flag": "c", "val`, nil, "EOF"},
+		{"counters not an object", `{"version": 1, "counters": [1, 2]}`, nil, "Invalid counters"},
+	} {
+		counters, err := decodeVarnishstat(ctx, []byte(test.json))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		names := []string{}
+		for _, counter := range counters {
+			names = append(names, counter.Name)
+		}
+		if !matchStringSlices(names, test.counters) {
+			t.Errorf("%s: expected counters %v, got %v", test.name, test.counters, names)
+		}
+	}
+}
+
+func Test_Varnish7Backends(t *testing.T) {
+	dir, _ := os.Getwd()
+	test := filepath.Join(dir, "test/scrape/synthetic-7.6.1.json")
+	if !fileExists(test) {
+		t.Skipf("Cannot find test file %s", test)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&testCollector{filepath: test, t: t})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != "varnish_backend_up" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range m.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			servers[labels["backend"]+" "+labels["server"]] = m.GetGauge().GetValue()
+		}
+	}
+	t.Logf("varnish_backend_up %v", servers)
+	// Only the backends of the latest VCL, vmod_dynamic backends are named <director>(<address>)
+	expected := map[string]float64{
+		"default unknown":   0,
+		"dyn 192.0.2.10:80": 1,
+		"dyn 192.0.2.11:80": 0,
+	}
+	if len(servers) != len(expected) {
+		t.Fatalf("expected backends %v, got %v", expected, servers)
+	}
+	for server, up := range expected {
+		if value, ok := servers[server]; !ok || value != up {
+			t.Errorf("%s: expected up %v, got %v", server, up, value)
+		}
+	}
+
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), "varnish_smf_") {
+			for _, m := range family.GetMetric() {
+				if label := m.GetLabel(); len(label) != 1 || label[0].GetName() != "type" || label[0].GetValue() != "s0" {
+					t.Errorf("%s: unexpected labels %v", family.GetName(), label)
+				}
+			}
+		}
+	}
+}
+
+// The counters and backend names of each Varnish version are in its fixture.
+func Test_VarnishVersionFixtures(t *testing.T) {
+	newer := func(version string, major, minor int) bool {
+		v := NewVarnishVersion()
+		v.parseVersion(version)
+		return v.EqualsOrGreater(major, minor)
+	}
+	for _, file := range readScrapeFiles(t) {
+		if !newer(file.version, 6, 5) {
+			continue
+		}
+		buf := file.buf
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+			if _, err := ScrapeVarnishFrom(context.Background(), testTarget, buf, ch, nil); err != nil {
+				t.Fatal(err)
+			}
+		}))
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		series := make(map[string]bool)
+		for _, family := range goldenFamilies(families) {
+			for _, s := range family.series {
+				series[s] = true
+			}
+		}
+
+		for s, expected := range map[string]bool{
+			// vmod_dynamic backends, <director>(<address>:<port>)
+			`varnish_backend_up{backend="dyn",server="192.0.2.10:80"}`: newer(file.version, 6, 6),
+			// The tcp_pool lock is conn_pool since 7.0
+			`varnish_lock_created{target="tcp_pool"}`:  !newer(file.version, 7, 0),
+			`varnish_lock_created{target="conn_pool"}`: newer(file.version, 7, 0),
+			`varnish_main_esi_req{}`:                   newer(file.version, 7, 0),
+			// HTTP/2 rapid reset mitigation
+			`varnish_main_req_reset{}`:         newer(file.version, 7, 4),
+			`varnish_main_sc_rapid_reset{}`:    newer(file.version, 7, 4),
+			`varnish_main_backend_wait{}`:      newer(file.version, 7, 6),
+			`varnish_main_backend_wait_fail{}`: newer(file.version, 7, 6),
+		} {
+			if series[s] != expected {
+				t.Errorf("%s: expected %s exported %v", file.version, s, expected)
+			}
+		}
+	}
+}
+
+// The test/scrape files, for benchmarks and fuzz seeds
+type scrapeFile struct {
+	version string
+	buf     []byte
+}
+
+func readScrapeFiles(tb testing.TB) []scrapeFile {
+	dir, _ := os.Getwd()
+	paths, _ := filepath.Glob(filepath.Join(dir, "test/scrape/*.json"))
+	if len(paths) == 0 {
+		tb.Skipf("Cannot find test/scrape files from working dir %s", dir)
+	}
+	files := []scrapeFile{}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		files = append(files, scrapeFile{strings.TrimSuffix(filepath.Base(path), ".json"), buf})
+	}
+	return files
+}
+
+// Benchmarks over every test/scrape file, run with
+// go test -run none -bench . -benchmem
+func Benchmark_DecodeVarnishstat(b *testing.B) {
+	ctx := context.Background()
+	for _, file := range readScrapeFiles(b) {
+		buf := file.buf
+		b.Run(file.version, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeVarnishstat(ctx, buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Allocations of a whole scrape, from the JSON to the metrics.
+func Benchmark_ScrapeVarnishFrom(b *testing.B) {
+	ctx := context.Background()
+	for _, file := range readScrapeFiles(b) {
+		buf := file.buf
+		b.Run(file.version, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(buf)))
+			ch := make(chan prometheus.Metric, 1024)
+			done := make(chan struct{})
+			go func() {
+				for range ch {
+				}
+				close(done)
+			}()
+			for i := 0; i < b.N; i++ {
+				if _, err := ScrapeVarnishFrom(ctx, testTarget, buf, ch, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+			close(ch)
+			<-done
+		})
+	}
+}
+
+// Malformed varnishstat output must fail the scrape with an error or skip the
+// counters, never panic. Run with the minimization of the large seeds limited
+// go test -run none -fuzz Fuzz_ScrapeVarnishFrom -fuzzminimizetime 10x
+func Fuzz_ScrapeVarnishFrom(f *testing.F) {
+	for _, file := range readScrapeFiles(f) {
+		f.Add(file.buf)
+	}
+	for _, seed := range []string{
+		`{"version": 1, "counters": {"MAIN.uptime": {"flag": "c", "value": 1}}}`,
+		`{"version": 1, "counters": []}`,
+		`{"version": 2, "counters": {"VBE.boot.default.happy": {"flag": "b", "value": 18446744073709551615}}}`,
+		`{"timestamp": "2021-01-01T00:00:00", "MAIN.uptime": {"value": "1"}, "SMA.s0.g_bytes": {"ident": "s0", "value": -1}}`,
+		`{"version": 1, "counters": {"MAIN.a b{c}": {"value": 1e400}, "VBE..": {"value": 1}, "...": {}}}`,
+		`{"version": 1, "counters": {"VBE.reload_.happy": {"flag": "b", "value": 1}}}`,
+	} {
+		f.Add([]byte(seed))
+	}
+	ctx := context.Background()
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		ch := make(chan prometheus.Metric)
+		done := make(chan error)
+		go func() {
+			var err error
+			for m := range ch {
+				if err == nil {
+					err = m.Write(&dto.Metric{})
+				}
+			}
+			done <- err
+		}()
+		_, err := ScrapeVarnishFrom(ctx, testTarget, buf, ch, nil)
+		close(ch)
+		if werr := <-done; werr != nil {
+			t.Errorf("invalid metric: %s", werr)
+		}
+		if err != nil {
+			t.Logf("scrape error: %s", err)
+		}
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// VCL names as accepted by vcl.load, and UUIDs named by older reload scripts
+var regexVCLName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// varnishVCL is a VCL of 'varnishadm vcl.list'.
+type varnishVCL struct {
+	Name string
+	// active, available or discarded
+	Status string
+	// auto, warm or cold, empty for Varnish 4.0
+	State string
+	// init, warm, cooling, busy or cold, empty for Varnish 4.0
+	Temperature string
+	// VCL the label points to, empty unless the VCL is a label
+	Label string
+}
+
+// Returns true if the backends of the VCL are in use, or the temperature is not known.
+func (v *varnishVCL) Warm() bool {
+	if v.Status == "discarded" {
+		return false
+	}
+	switch v.Temperature {
+	case "cold", "cooling":
+		return false
+	}
+	return true
+}
+
+// Parses 'varnishadm vcl.list' output, the lines are
+//
+//	active      auto/warm          0 boot
+//	available   cold/cold          0 reload_20191014_091124_78599
+//	available  label/warm          0 prod -> boot
+//	active          0 boot                           (Varnish 4.0)
+func parseVCLList(out string) ([]*varnishVCL, error) {
+	var vcls []*varnishVCL
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		vcl := &varnishVCL{Status: fields[0]}
+		switch {
+		case len(fields) == 3:
+			vcl.Name = fields[2]
+		case len(fields) >= 4:
+			vcl.State, vcl.Temperature, _ = strings.Cut(fields[1], "/")
+			vcl.Name = fields[3]
+			if len(fields) >= 6 && fields[4] == "->" {
+				vcl.Label = fields[5]
+			}
+		default:
+			return nil, fmt.Errorf("Unexpected vcl.list line %q", line)
+		}
+		vcls = append(vcls, vcl)
+	}
+	return vcls, nil
+}
+
+// Returns the VCLs of target from 'varnishadm vcl.list'.
+func fetchVCLs(ctx context.Context, target *scrapeTarget) ([]*varnishVCL, error) {
+	var params []string
+	if target.params.Instance != "" {
+		params = append(params, "-n", target.params.Instance)
+	}
+	params = append(params, "vcl.list")
+	buf, err := target.exec(ctx, StartParams.VarnishadmExe, params...)
+	if err != nil {
+		if out := strings.TrimSpace(buf.String()); out != "" {
+			return nil, fmt.Errorf("%s: %s", err, out)
+		}
+		return nil, err
+	}
+	return parseVCLList(buf.String())
+}
+
+// Returns the VCLs whose VBE counters are skipped with -vcl.skip-cold and
+// -vcl.active-only, from the vcl.list of target. Returns nil on errors.
+func fetchSkippedVCLs(ctx context.Context, target *scrapeTarget) map[string]bool {
+	vcls, err := fetchVCLs(ctx, target)
+	if err != nil {
+		logScrape.WarnContext(ctx, "Failed to list VCLs, VBE counters are not filtered by VCL state", "varnishadm", StartParams.VarnishadmExe, "err", err)
+		return nil
+	}
+	active := ""
+	for _, vcl := range vcls {
+		if vcl.Status == "active" {
+			// The counters are named by the VCL an active label points to
+			if active = vcl.Name; vcl.Label != "" {
+				active = vcl.Label
+			}
+		}
+	}
+	skipped := make(map[string]bool)
+	for _, vcl := range vcls {
+		if vcl.Label != "" {
+			continue
+		}
+		if (StartParams.VCLActiveOnly && active != "" && vcl.Name != active) || (StartParams.SkipColdVCLs && !vcl.Warm()) {
+			skipped[vcl.Name] = true
+		}
+	}
+	return skipped
+}
+
+// Returns the VCL name of a VBE counter, "VBE.<vcl>.<backend>.<counter>" since
+// Varnish 4.1. Empty if the name has no VCL.
+func vbeVCLName(vName string, version *varnishVersion) string {
+	if !strings.HasPrefix(vName, "VBE.") || (version.Valid() && !version.EqualsOrGreater(4, 1)) {
+		return ""
+	}
+	name := vName[len("VBE."):]
+	if dot := strings.Index(name, "."); dot != -1 && regexVCLName.MatchString(name[:dot]) {
+		return name[:dot]
+	}
+	return ""
+}
+
+// Returns labelValues with the VCL name removed from the start of the backend and director
+// labels, the vcl label has it. cleanBackendName only knows the boot and reload VCL names.
+func trimVCLName(labelKeys, labelValues []string, vcl string) []string {
+	for i, key := range labelKeys {
+		if (key == "backend" || key == "director") && len(labelValues[i]) > len(vcl)+1 && startsWith(labelValues[i], vcl+".", caseInsensitive) {
+			labelValues[i] = labelValues[i][len(vcl)+1:]
+		}
+	}
+	return labelValues
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const testVCLList = `active      auto/warm          0 boot
+available   cold/cold          0 reload_20210114_155148_19902
+available   auto/cooling       0 reload_20210114_160902_21476
+discarded   cold/busy          2 old
+available  label/warm          0 prod -> boot
+`
+
+func Test_ParseVCLList(t *testing.T) {
+	vcls, err := parseVCLList(testVCLList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []varnishVCL{
+		{Name: "boot", Status: "active", State: "auto", Temperature: "warm"},
+		{Name: "reload_20210114_155148_19902", Status: "available", State: "cold", Temperature: "cold"},
+		{Name: "reload_20210114_160902_21476", Status: "available", State: "auto", Temperature: "cooling"},
+		{Name: "old", Status: "discarded", State: "cold", Temperature: "busy"},
+		{Name: "prod", Status: "available", State: "label", Temperature: "warm", Label: "boot"},
+	}
+	if len(vcls) != len(expected) {
+		t.Fatalf("expected %d VCLs, got %d", len(expected), len(vcls))
+	}
+	for i, vcl := range vcls {
+		t.Logf("%+v warm=%v", *vcl, vcl.Warm())
+		if *vcl != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], *vcl)
+		}
+	}
+	if !vcls[0].Warm() || vcls[1].Warm() || vcls[2].Warm() || vcls[3].Warm() {
+		t.Error("unexpected VCL temperature")
+	}
+
+	// Varnish 4.0 has no temperature
+	vcls, err = parseVCLList("active          0 boot\navailable       0 foo\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vcls) != 2 || vcls[1].Name != "foo" || !vcls[1].Warm() {
+		t.Errorf("unexpected 4.0 VCLs %+v", vcls)
+	}
+
+	if _, err = parseVCLList("Unknown request.\nType 'help' for more info.\n"); err == nil {
+		t.Error("expected error from invalid output")
+	}
+}
+
+func Test_SkipColdVCLs(t *testing.T) {
+	stats := `{"version": 1, "counters": {
+		"VBE.boot.web.happy": {"flag": "b", "format": "b", "value": 1},
+		"VBE.canary.web.happy": {"flag": "b", "format": "b", "value": 1},
+		"VBE.old.web.happy": {"flag": "b", "format": "b", "value": 1}
+	}}`
+	vclList := "active      auto/warm          0 boot\navailable   auto/warm          0 canary\navailable   cold/cold          0 old\n"
+	target := newScrapeTarget("test", nil, nil, func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+		if exe == StartParams.VarnishadmExe {
+			return bytes.NewBufferString(vclList), nil
+		}
+		return bytes.NewBufferString(stats), nil
+	})
+	target.version.parseVersion("6.5.1")
+
+	backends := func(skip bool) int {
+		previous := StartParams.SkipColdVCLs
+		StartParams.SkipColdVCLs = skip
+		defer func() { StartParams.SkipColdVCLs = previous }()
+
+		ch := make(chan prometheus.Metric, 100)
+		if _, err := ScrapeVarnish(context.Background(), target, ch, nil); err != nil {
+			t.Fatal(err)
+		}
+		close(ch)
+		happy := 0
+		for m := range ch {
+			if strings.Contains(m.Desc().String(), `"varnish_backend_happy"`) {
+				happy++
+			}
+		}
+		return happy
+	}
+	if n := backends(false); n != 3 {
+		t.Errorf("expected 3 backends, got %d", n)
+	}
+	if n := backends(true); n != 2 {
+		t.Errorf("expected 2 backends with -vcl.skip-cold, got %d", n)
+	}
+}
+
+func Test_VCLLabel(t *testing.T) {
+	dir, _ := os.Getwd()
+	stats, err := ioutil.ReadFile(filepath.Join(dir, "test/scrape/synthetic-7.6.1.json"))
+	if err != nil {
+		t.Skipf("Cannot read test file: %s", err)
+	}
+	// Rolled back to the boot VCL with vcl.use
+	vclList := `available   auto/warm          0 boot
+available   auto/warm          0 reload_20210114_155148_19902
+available   auto/warm          0 reload_20210114_160902_21476
+active     label/warm          0 prod -> boot
+`
+	target := newScrapeTarget("test", nil, nil, func(ctx context.Context, exe string, params ...string) (*bytes.Buffer, error) {
+		if exe == StartParams.VarnishadmExe {
+			return bytes.NewBufferString(vclList), nil
+		}
+		return bytes.NewBuffer(stats), nil
+	})
+	target.version.parseVersion("7.6.1")
+
+	backends := func(label, activeOnly bool) []string {
+		previousLabel, previousActiveOnly := StartParams.VCLLabel, StartParams.VCLActiveOnly
+		StartParams.VCLLabel, StartParams.VCLActiveOnly = label, activeOnly
+		defer func() { StartParams.VCLLabel, StartParams.VCLActiveOnly = previousLabel, previousActiveOnly }()
+
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+			if _, err := ScrapeVarnish(context.Background(), target, ch, nil); err != nil {
+				t.Fatal(err)
+			}
+		}))
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var servers []string
+		for _, family := range families {
+			if family.GetName() != "varnish_backend_up" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range m.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				server := labels["backend"] + " " + labels["server"]
+				if vcl, ok := labels["vcl"]; ok {
+					server = vcl + " " + server
+				}
+				servers = append(servers, server)
+			}
+		}
+		sort.Strings(servers)
+		t.Logf("label=%v active-only=%v: %v", label, activeOnly, servers)
+		return servers
+	}
+
+	for _, test := range []struct {
+		label, activeOnly bool
+		expected          []string
+	}{
+		{false, false, []string{"default unknown", "dyn 192.0.2.10:80", "dyn 192.0.2.11:80"}},
+		{true, false, []string{
+			"boot default unknown",
+			"reload_20210114_155148_19902 default unknown",
+			"reload_20210114_160902_21476 default unknown",
+			"reload_20210114_160902_21476 dyn 192.0.2.10:80",
+			"reload_20210114_160902_21476 dyn 192.0.2.11:80",
+		}},
+		{true, true, []string{"boot default unknown"}},
+		{false, true, []string{"default unknown"}},
+	} {
+		if servers := backends(test.label, test.activeOnly); !matchStringSlices(servers, test.expected) {
+			t.Errorf("label=%v active-only=%v: expected %v, got %v", test.label, test.activeOnly, test.expected, servers)
+		}
+	}
+}
+
+// A VCL named other than boot or reload_* is removed from the backend with the vcl label
+func Test_VCLLabelCustomName(t *testing.T) {
+	previous := StartParams.VCLLabel
+	t.Cleanup(func() { StartParams.VCLLabel = previous })
+
+	buf := []byte(`{"version": 1, "counters": {
+		"VBE.blue.default.happy": {"flag": "b", "format": "b", "value": 1},
+		"VBE.Green.api.happy": {"flag": "b", "format": "b", "value": 1},
+		"VBE.blue.blue.happy": {"flag": "b", "format": "b", "value": 1}
+	}}`)
+	target := newScrapeTarget("test", nil, nil, nil)
+	target.version.parseVersion("7.6.1")
+
+	backends := func(label bool) []string {
+		StartParams.VCLLabel = label
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(collectorFunc(func(ch chan<- prometheus.Metric) {
+			if _, err := ScrapeVarnishFrom(context.Background(), target, buf, ch, nil); err != nil {
+				t.Fatal(err)
+			}
+		}))
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var backends []string
+		for _, family := range families {
+			if family.GetName() != "varnish_backend_happy" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				labels := make(map[string]string)
+				for _, label := range m.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+				backends = append(backends, strings.TrimSpace(labels["vcl"]+" "+labels["backend"]))
+			}
+		}
+		sort.Strings(backends)
+		t.Logf("label=%v: %v", label, backends)
+		return backends
+	}
+
+	if expected, actual := []string{"Green api", "blue blue", "blue default"}, backends(true); !matchStringSlices(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	// Without the vcl label the backends of different VCLs need the VCL name to differ
+	if expected, actual := []string{"blue.blue", "blue.default", "green.api"}, backends(false); !matchStringSlices(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+type collectorFunc func(ch chan<- prometheus.Metric)
+
+func (f collectorFunc) Describe(ch chan<- *prometheus.Desc) {
+}
+
+func (f collectorFunc) Collect(ch chan<- prometheus.Metric) {
+	f(ch)
+}
+
+func Test_VBEVCLName(t *testing.T) {
+	modern, old := NewVarnishVersion(), NewVarnishVersion()
+	modern.parseVersion("6.0.0")
+	old.parseVersion("4.0.3")
+	for _, test := range []struct {
+		vName    string
+		version  *varnishVersion
+		expected string
+	}{
+		{"VBE.boot.default.happy", modern, "boot"},
+		{"VBE.reload_20191016_072034_54500.default.happy", modern, "reload_20191016_072034_54500"},
+		{"VBE.ce19737f-72b5-4f4b-9d39-3d8c2d28240b.default.happy", modern, "ce19737f-72b5-4f4b-9d39-3d8c2d28240b"},
+		{"VBE.root:eu2_x.y-z:w.happy", modern, ""},
+		{"VBE.eu1_x.y-z:w(192.52.0.192,,8085).happy", old, ""},
+		{"MAIN.uptime", modern, ""},
+	} {
+		if vcl := vbeVCLName(test.vName, test.version); vcl != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.vName, test.expected, vcl)
+		}
+	}
+}